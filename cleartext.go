@@ -0,0 +1,200 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ListenAndServeCleartext listens on the TCP network address
+// addr and then calls ServeCleartext with handler to handle
+// requests on incoming connections. Handler is typically nil,
+// in which case the DefaultServeMux is used.
+//
+// IMPORTANT NOTE: Connections are not encrypted. This should
+// only be used in trusted networks, such as for internal
+// services and testing.
+func ListenAndServeCleartext(addr string, handler http.Handler, version, subversion int) error {
+	if addr == "" {
+		addr = ":http"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return ServeCleartext(l, handler, version, subversion)
+}
+
+// ServeCleartext accepts incoming connections on the Listener
+// l and serves the given version of SPDY directly over each
+// connection, without TLS or protocol negotiation. Clients
+// must therefore have prior knowledge that the server speaks
+// SPDY. Handler is typically nil, in which case the
+// DefaultServeMux is used.
+func ServeCleartext(l net.Listener, handler http.Handler, version, subversion int) error {
+	if err := checkVersion(version, subversion); err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: handler}
+
+	return serve(l, func(conn net.Conn) {
+		serveSPDYCleartext(conn, server, version, subversion)
+	})
+}
+
+// ServeCleartextAndHTTP accepts incoming connections on the
+// Listener l and serves both SPDY and HTTP/1.1 on the same
+// port, without TLS. The first bytes sent by each client are
+// used to distinguish a SPDY control frame from an HTTP/1.1
+// request line. SPDY connections are served using the given
+// version. Handler is typically nil, in which case the
+// DefaultServeMux is used.
+func ServeCleartextAndHTTP(l net.Listener, handler http.Handler, version, subversion int) error {
+	if err := checkVersion(version, subversion); err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: handler}
+	httpListener := newSniffListener(l)
+	go server.Serve(httpListener)
+	defer httpListener.Close()
+
+	return serve(l, func(conn net.Conn) {
+		serveSniffed(conn, server, httpListener, version, subversion)
+	})
+}
+
+// checkVersion ensures that the given SPDY version
+// can be served.
+func checkVersion(version, subversion int) error {
+	switch {
+	case version == 3 && (subversion == 0 || subversion == 1):
+		return nil
+	case version == 2 && subversion == 0:
+		return nil
+	default:
+		return errors.New("Error: Unsupported SPDY version.")
+	}
+}
+
+func serveSPDYCleartext(conn net.Conn, srv *http.Server, version, subversion int) {
+	defer func() {
+		if v := recover(); v != nil {
+			const size = 4096
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("panic serving %v: %v\n%s", conn.RemoteAddr(), v, buf)
+		}
+	}()
+
+	serverConn, err := NewServerConn(conn, srv, version, subversion)
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return
+	}
+	serverConn.Run()
+}
+
+// serveSniffed determines whether the client is speaking
+// SPDY or HTTP/1.1, then serves the connection accordingly.
+func serveSniffed(conn net.Conn, srv *http.Server, httpListener *sniffListener, version, subversion int) {
+	if d := srv.ReadTimeout; d != 0 {
+		conn.SetReadDeadline(time.Now().Add(d))
+	}
+
+	// SPDY connections start with a control frame,
+	// which has the control bit set, followed by
+	// the version. HTTP request lines start with a
+	// printable method name.
+	buf := bufio.NewReader(conn)
+	start, err := buf.Peek(2)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	// The deadline only applies to sniffing. The
+	// connection's own timeouts are set by the server
+	// it is handed to.
+	conn.SetReadDeadline(time.Time{})
+	conn = &sniffedConn{conn, buf}
+
+	if start[0]&0x80 == 0 {
+		httpListener.serve(conn)
+		return
+	}
+
+	if int(start[1]) != version {
+		debug.Printf("Refusing connection from %v using SPDY/%d.\n", conn.RemoteAddr(), start[1])
+		conn.Close()
+		return
+	}
+
+	serveSPDYCleartext(conn, srv, version, subversion)
+}
+
+// sniffedConn is a net.Conn whose initial data has
+// been buffered while determining its protocol.
+type sniffedConn struct {
+	net.Conn
+	buf *bufio.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.buf.Read(b)
+}
+
+// sniffListener is a net.Listener which provides the
+// HTTP/1.1 connections found by serveSniffed to an
+// http.Server.
+type sniffListener struct {
+	net.Listener
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSniffListener(l net.Listener) *sniffListener {
+	out := new(sniffListener)
+	out.Listener = l
+	out.conns = make(chan net.Conn)
+	out.done = make(chan struct{})
+	return out
+}
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("Error: Listener closed.")
+	}
+}
+
+func (l *sniffListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// serve passes conn to the http.Server, or closes
+// it if the listener has been closed.
+func (l *sniffListener) serve(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
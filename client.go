@@ -30,12 +30,12 @@ func NewClientConn(conn net.Conn, push common.Receiver, version, subversion int)
 
 	switch version {
 	case 3:
-		out := spdy3.NewConn(conn, nil, subversion)
+		out := spdy3.NewConn(conn, nil, subversion, nil)
 		out.PushReceiver = push
 		return out, nil
 
 	case 2:
-		out := spdy2.NewConn(conn, nil)
+		out := spdy2.NewConn(conn, nil, nil)
 		out.PushReceiver = push
 		return out, nil
 
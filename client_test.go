@@ -14,6 +14,7 @@ import (
 	"testing"
 
 	"github.com/SlyMarbo/spdy"
+	"github.com/SlyMarbo/spdy/common"
 )
 
 func init() {
@@ -255,8 +256,12 @@ func pedanticReadAll(r io.Reader) (b []byte, err error) {
 }
 
 func newServer(handler http.Handler) *httptest.Server {
+	return newConfigServer(handler, nil)
+}
+
+func newConfigServer(handler http.Handler, config *common.Config) *httptest.Server {
 	ts := httptest.NewUnstartedServer(handler)
-	spdy.AddSPDY(ts.Config)
+	spdy.ConfigureServer(ts.Config, config)
 	ts.TLS = ts.Config.TLSConfig
 	ts.StartTLS()
 	return ts
@@ -0,0 +1,278 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AbuseEvent identifies a frame or event from the other
+// endpoint that is subject to an AbusePolicy.
+type AbuseEvent int
+
+const (
+	AbusePing     AbuseEvent = iota // PING sent by the other endpoint.
+	AbuseSettings                   // SETTINGS frame.
+	AbuseStream                     // stream opened by the other endpoint.
+	AbuseReset                      // RST_STREAM frame.
+	numAbuseEvents
+)
+
+func (e AbuseEvent) String() string {
+	switch e {
+	case AbusePing:
+		return "PING"
+	case AbuseSettings:
+		return "SETTINGS"
+	case AbuseStream:
+		return "SYN_STREAM"
+	case AbuseReset:
+		return "RST_STREAM"
+	default:
+		return "Unknown event"
+	}
+}
+
+// RateLimit is a token bucket. Burst events are allowed at
+// once, and the allowance is refilled at Rate events per
+// second. A zero Burst means that there is no limit.
+type RateLimit struct {
+	Rate  float64 // events per second.
+	Burst int     // maximum events at once.
+}
+
+// AbuseLimits is the set of rate limits applied to
+// each type of AbuseEvent.
+type AbuseLimits struct {
+	Pings    RateLimit
+	Settings RateLimit
+	Streams  RateLimit
+	Resets   RateLimit
+}
+
+func (l *AbuseLimits) limit(e AbuseEvent) RateLimit {
+	switch e {
+	case AbusePing:
+		return l.Pings
+	case AbuseSettings:
+		return l.Settings
+	case AbuseStream:
+		return l.Streams
+	case AbuseReset:
+		return l.Resets
+	}
+	return RateLimit{}
+}
+
+// AbuseCounts holds a counter for each type of AbuseEvent.
+type AbuseCounts struct {
+	Pings    uint64
+	Settings uint64
+	Streams  uint64
+	Resets   uint64
+}
+
+// AbuseStats is a snapshot of an AbusePolicy's counters.
+type AbuseStats struct {
+	Received    AbuseCounts // events received.
+	Violations  AbuseCounts // events over the limits.
+	Connections uint64      // connections ended for abuse.
+	RemoteIPs   int         // remote IPs currently tracked.
+}
+
+// AbusePolicy rate-limits control frames and stream churn
+// from the other endpoint, both per connection and per
+// remote IP. A connection that exceeds either set of limits
+// is ended with a GOAWAY.
+//
+// The limits should not be modified once the policy is in
+// use.
+type AbusePolicy struct {
+	Conn AbuseLimits // limits for each connection.
+	IP   AbuseLimits // limits across all connections from a remote IP.
+
+	lock sync.Mutex
+	ips  map[string]*ipAbuse
+
+	received    [numAbuseEvents]uint64
+	violations  [numAbuseEvents]uint64
+	connections uint64
+}
+
+// NewAbusePolicy produces an AbusePolicy with the given limits.
+func NewAbusePolicy(conn, ip AbuseLimits) *AbusePolicy {
+	out := new(AbusePolicy)
+	out.Conn = conn
+	out.IP = ip
+	out.ips = make(map[string]*ipAbuse)
+	return out
+}
+
+// DefaultAbusePolicy is used by connections created without
+// a Config. If nil, no abuse protection is performed.
+var DefaultAbusePolicy = NewAbusePolicy(
+	AbuseLimits{
+		Pings:    RateLimit{Rate: 10, Burst: 50},
+		Settings: RateLimit{Rate: 10, Burst: 50},
+		Streams:  RateLimit{Rate: 200, Burst: 1000},
+		Resets:   RateLimit{Rate: 100, Burst: 500},
+	},
+	AbuseLimits{
+		Pings:    RateLimit{Rate: 100, Burst: 500},
+		Settings: RateLimit{Rate: 100, Burst: 500},
+		Streams:  RateLimit{Rate: 2000, Burst: 10000},
+		Resets:   RateLimit{Rate: 1000, Burst: 5000},
+	},
+)
+
+// Stats returns a snapshot of the policy's counters.
+func (p *AbusePolicy) Stats() AbuseStats {
+	var out AbuseStats
+	counts := func(c *[numAbuseEvents]uint64) AbuseCounts {
+		return AbuseCounts{
+			Pings:    atomic.LoadUint64(&c[AbusePing]),
+			Settings: atomic.LoadUint64(&c[AbuseSettings]),
+			Streams:  atomic.LoadUint64(&c[AbuseStream]),
+			Resets:   atomic.LoadUint64(&c[AbuseReset]),
+		}
+	}
+	out.Received = counts(&p.received)
+	out.Violations = counts(&p.violations)
+	out.Connections = atomic.LoadUint64(&p.connections)
+	p.lock.Lock()
+	out.RemoteIPs = len(p.ips)
+	p.lock.Unlock()
+	return out
+}
+
+// Track begins tracking a new connection from the given
+// remote address. The returned AbuseTracker must be closed
+// when the connection ends.
+func (p *AbusePolicy) Track(addr net.Addr) *AbuseTracker {
+	ip := ""
+	if addr != nil {
+		ip = addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+	}
+
+	p.lock.Lock()
+	if p.ips == nil {
+		p.ips = make(map[string]*ipAbuse)
+	}
+	shared := p.ips[ip]
+	if shared == nil {
+		shared = new(ipAbuse)
+		p.ips[ip] = shared
+	}
+	shared.conns++
+	p.lock.Unlock()
+
+	out := new(AbuseTracker)
+	out.policy = p
+	out.ip = ip
+	out.shared = shared
+	return out
+}
+
+// ipAbuse is the state shared by all
+// connections from a remote IP.
+type ipAbuse struct {
+	lock    sync.Mutex
+	buckets [numAbuseEvents]bucket
+	conns   int // protected by AbusePolicy.lock.
+}
+
+// AbuseTracker applies an AbusePolicy to a
+// single connection.
+type AbuseTracker struct {
+	policy  *AbusePolicy
+	ip      string
+	shared  *ipAbuse
+	lock    sync.Mutex
+	buckets [numAbuseEvents]bucket
+	closed  bool
+}
+
+// Allow is called when the given event is received
+// from the other endpoint, and returns false if the
+// event exceeds the policy's limits. The connection
+// should then be ended.
+func (t *AbuseTracker) Allow(e AbuseEvent) bool {
+	if e < 0 || e >= numAbuseEvents {
+		return true
+	}
+	p := t.policy
+	atomic.AddUint64(&p.received[e], 1)
+	now := time.Now()
+
+	t.lock.Lock()
+	ok := t.buckets[e].take(p.Conn.limit(e), now)
+	t.lock.Unlock()
+	if ok {
+		t.shared.lock.Lock()
+		ok = t.shared.buckets[e].take(p.IP.limit(e), now)
+		t.shared.lock.Unlock()
+	}
+
+	if !ok {
+		atomic.AddUint64(&p.violations[e], 1)
+	}
+	return ok
+}
+
+// Violation records that the connection was ended
+// for exceeding the policy's limits.
+func (t *AbuseTracker) Violation() {
+	atomic.AddUint64(&t.policy.connections, 1)
+}
+
+// Close stops tracking the connection. Close can be
+// called multiple times safely.
+func (t *AbuseTracker) Close() {
+	p := t.policy
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	t.shared.conns--
+	if t.shared.conns <= 0 && p.ips[t.ip] == t.shared {
+		delete(p.ips, t.ip)
+	}
+}
+
+// bucket is the state of a RateLimit.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token from the bucket, returning
+// false if none are available.
+func (b *bucket) take(limit RateLimit, now time.Time) bool {
+	if limit.Burst <= 0 {
+		return true
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(limit.Burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+		if max := float64(limit.Burst); b.tokens > max {
+			b.tokens = max
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,205 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AccessLogger is used to record the details of completed
+// streams. LogStream is called once for each stream, and
+// may be called concurrently.
+type AccessLogger interface {
+	LogStream(*StreamLog)
+}
+
+// AccessLoggerFunc is an adapter to allow the use of ordinary
+// functions as AccessLoggers.
+type AccessLoggerFunc func(*StreamLog)
+
+func (f AccessLoggerFunc) LogStream(l *StreamLog) {
+	f(l)
+}
+
+// StreamEnd describes how a stream ended.
+type StreamEnd int
+
+const (
+	StreamFinished StreamEnd = iota // closed with FIN.
+	StreamReset                     // reset with RST_STREAM.
+	StreamGoaway                    // connection ended first.
+)
+
+func (e StreamEnd) String() string {
+	switch e {
+	case StreamFinished:
+		return "FIN"
+	case StreamReset:
+		return "RST"
+	case StreamGoaway:
+		return "GOAWAY"
+	default:
+		return "Unknown end"
+	}
+}
+
+// StreamLog contains the details of a completed stream.
+//
+// BytesOut counts the response body bytes accepted from
+// the handler, rather than those written to the network.
+// Data still buffered by flow control or queued when the
+// stream is reset is included, though it is never sent.
+type StreamLog struct {
+	ConnID   uint64        // unique to each connection.
+	StreamID StreamID      //
+	Version  float64       // SPDY version, eg 3.1.
+	Priority Priority      //
+	Request  *http.Request // request being served.
+	Pushed   bool          // whether the stream was a server push.
+	Status   int           // response status, or 0 if none was sent.
+	BytesIn  int64         // request body bytes received.
+	BytesOut int64         // response body bytes accepted for sending.
+	Start    time.Time     // when the stream was opened.
+	TTFB     time.Duration // time until the response headers were sent.
+	Duration time.Duration // time until the stream ended.
+	End      StreamEnd     // how the stream ended.
+	Reset    StatusCode    // RST_STREAM status, if reset.
+}
+
+func (l *StreamLog) String() string {
+	method, uri := "-", "-"
+	if l.Request != nil {
+		method = l.Request.Method
+		if l.Request.URL != nil {
+			uri = l.Request.URL.RequestURI()
+		}
+	}
+	end := l.End.String()
+	if l.End == StreamReset {
+		end += " " + l.Reset.String()
+	}
+	return fmt.Sprintf("conn=%d stream=%d version=%g priority=%d %q status=%d in=%d out=%d ttfb=%v duration=%v pushed=%t end=%q",
+		l.ConnID, l.StreamID, l.Version, l.Priority, method+" "+uri, l.Status, l.BytesIn, l.BytesOut,
+		l.TTFB, l.Duration, l.Pushed, end)
+}
+
+// NewAccessLogger returns an AccessLogger which writes
+// each StreamLog to w on its own line.
+func NewAccessLogger(w io.Writer) AccessLogger {
+	out := new(writerAccessLogger)
+	out.w = w
+	return out
+}
+
+type writerAccessLogger struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (w *writerAccessLogger) LogStream(l *StreamLog) {
+	w.Lock()
+	fmt.Fprintln(w.w, l)
+	w.Unlock()
+}
+
+var lastConnID uint64
+
+// NextConnID returns a new connection ID, for use
+// in access logs.
+func NextConnID() uint64 {
+	return atomic.AddUint64(&lastConnID, 1)
+}
+
+// StreamRecorder collects the details of a stream as it
+// progresses, passing them to the AccessLogger when it
+// ends. A nil *StreamRecorder is valid, and does nothing.
+type StreamRecorder struct {
+	sync.Mutex
+	log    StreamLog
+	logger AccessLogger
+	done   bool
+}
+
+// NewStreamRecorder returns a StreamRecorder for a new
+// stream, which passes its details to logger. If logger
+// is nil, access logging is disabled, and nil is returned.
+func NewStreamRecorder(logger AccessLogger, connID uint64, streamID StreamID, version float64, priority Priority, request *http.Request, pushed bool) *StreamRecorder {
+	if logger == nil {
+		return nil
+	}
+
+	out := new(StreamRecorder)
+	out.logger = logger
+	out.log.ConnID = connID
+	out.log.StreamID = streamID
+	out.log.Version = version
+	out.log.Priority = priority
+	out.log.Request = request
+	out.log.Pushed = pushed
+	out.log.Start = time.Now()
+	return out
+}
+
+// Received records request body data.
+func (r *StreamRecorder) Received(n int) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	r.log.BytesIn += int64(n)
+	r.Unlock()
+}
+
+// Sent records response body data accepted
+// from the handler.
+func (r *StreamRecorder) Sent(n int) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	r.log.BytesOut += int64(n)
+	r.Unlock()
+}
+
+// WroteHeader records that the response headers
+// have been sent with the given status.
+func (r *StreamRecorder) WroteHeader(status int) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	if r.log.Status == 0 {
+		r.log.Status = status
+		r.log.TTFB = time.Since(r.log.Start)
+	}
+	r.Unlock()
+}
+
+// Finish records how the stream ended and passes the
+// details to the AccessLogger. Only the first call to
+// Finish has any effect.
+func (r *StreamRecorder) Finish(end StreamEnd, reset StatusCode) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	if r.done {
+		r.Unlock()
+		return
+	}
+	r.done = true
+	r.log.End = end
+	r.log.Reset = reset
+	r.log.Duration = time.Since(r.log.Start)
+	log := r.log
+	r.Unlock()
+
+	r.logger.LogStream(&log)
+}
@@ -0,0 +1,188 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// AutoFlowControl is a FlowControl which tunes each receive
+// window to the bandwidth-delay product of its stream, so that
+// high-latency links are not limited by a small window.
+//
+// The bandwidth is estimated from the rate at which DATA
+// arrives, and the delay from the round-trip time measured
+// with PINGs, which the connection reports with ObserveRTT.
+// Each window is grown to twice the estimated product, up to
+// MaxWindow for streams, or MaxSessionWindow for the session
+// window in SPDY/3.1. Under memory pressure, windows are
+// shrunk back to the initial window size.
+//
+// An AutoFlowControl keeps state for each stream, so must
+// not be shared between connections.
+type AutoFlowControl struct {
+	Initial          uint32 // initial window size for new streams.
+	MaxWindow        uint32 // ceiling on each stream's window.
+	MaxSessionWindow uint32 // ceiling on the session window.
+
+	// Pressure reports whether memory is scarce, in which
+	// case windows are shrunk rather than grown. If nil,
+	// there is assumed to be no pressure.
+	Pressure func() bool
+
+	lock    sync.Mutex
+	rtt     time.Duration
+	windows map[StreamID]*autoWindow
+	calls   int
+}
+
+// autoWindow is the state of one
+// window tuned by AutoFlowControl.
+type autoWindow struct {
+	target   int64     // window size being aimed for.
+	last     int64     // window size after the last update.
+	bytes    int64     // bytes received since start.
+	start    time.Time // start of the current rate sample.
+	rate     float64   // estimated arrival rate, in bytes per second.
+	lastSeen time.Time // time of the last update.
+}
+
+// autoWindowIdle is how long a window's state is kept
+// after its last update, as streams' ends are not seen.
+const autoWindowIdle = time.Minute
+
+// minRateSample is the shortest interval over
+// which the arrival rate is measured.
+const minRateSample = 10 * time.Millisecond
+
+// NewAutoFlowControl produces an AutoFlowControl with the
+// given initial window size, whose stream windows may grow
+// to max. The session window may grow to four times max.
+// The initial window size should match the one advertised
+// by the connection, such as DEFAULT_INITIAL_WINDOW_SIZE
+// for servers.
+func NewAutoFlowControl(initial, max uint32) *AutoFlowControl {
+	if max < initial {
+		max = initial
+	}
+	session := int64(max) * 4
+	if session >= MAX_TRANSFER_WINDOW_SIZE {
+		session = MAX_TRANSFER_WINDOW_SIZE - 1
+	}
+
+	out := new(AutoFlowControl)
+	out.Initial = initial
+	out.MaxWindow = max
+	out.MaxSessionWindow = uint32(session)
+	return out
+}
+
+func (a *AutoFlowControl) InitialWindowSize() uint32 {
+	return a.Initial
+}
+
+// ObserveRTT records a round-trip time measured
+// on the connection.
+func (a *AutoFlowControl) ObserveRTT(rtt time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// Smooth the estimate, as in RFC 6298.
+	if a.rtt == 0 {
+		a.rtt = rtt
+	} else {
+		a.rtt = (7*a.rtt + rtt) / 8
+	}
+}
+
+// RTT returns the current estimate of the
+// connection's round-trip time, or 0 if it
+// has not been measured.
+func (a *AutoFlowControl) RTT() time.Duration {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.rtt
+}
+
+func (a *AutoFlowControl) ReceiveData(streamID StreamID, initialWindowSize uint32, newWindowSize int64) uint32 {
+	now := time.Now()
+	pressure := a.Pressure != nil && a.Pressure()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.windows == nil {
+		a.windows = make(map[StreamID]*autoWindow)
+	}
+	a.calls++
+	if a.calls%256 == 0 {
+		a.prune(now)
+	}
+
+	w := a.windows[streamID]
+	if w == nil {
+		w = &autoWindow{target: int64(initialWindowSize), last: int64(initialWindowSize), start: now}
+		a.windows[streamID] = w
+	}
+	w.lastSeen = now
+
+	// Measure the arrival rate.
+	if received := w.last - newWindowSize; received > 0 {
+		w.bytes += received
+	}
+	w.last = newWindowSize
+	interval := a.rtt
+	if interval < minRateSample {
+		interval = minRateSample
+	}
+	if elapsed := now.Sub(w.start); elapsed >= interval {
+		sample := float64(w.bytes) / elapsed.Seconds()
+		if w.rate == 0 {
+			w.rate = sample
+		} else {
+			w.rate = (w.rate + sample) / 2
+		}
+		w.bytes = 0
+		w.start = now
+	}
+
+	// Choose the target window.
+	ceiling := int64(a.MaxWindow)
+	if streamID == 0 {
+		ceiling = int64(a.MaxSessionWindow)
+	}
+	if ceiling < int64(initialWindowSize) {
+		ceiling = int64(initialWindowSize)
+	}
+	if pressure {
+		w.target = int64(initialWindowSize)
+	} else if bdp := int64(2 * w.rate * a.rtt.Seconds()); bdp > w.target {
+		w.target = bdp
+	}
+	if w.target > ceiling {
+		w.target = ceiling
+	}
+	if w.target < int64(initialWindowSize) {
+		w.target = int64(initialWindowSize)
+	}
+
+	if newWindowSize >= w.target/2 {
+		return 0
+	}
+	delta := w.target - newWindowSize
+	w.last += delta
+	return uint32(delta)
+}
+
+// prune discards the state of windows
+// which have not been updated recently.
+func (a *AutoFlowControl) prune(now time.Time) {
+	for id, w := range a.windows {
+		if id != 0 && now.Sub(w.lastSeen) > autoWindowIdle {
+			delete(a.windows, id)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"compress/zlib"
 	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 	"sync"
@@ -24,6 +25,35 @@ func init() {
 	zlibV3Writers = make(chan *zlib.Writer, 5)
 }
 
+// HeaderLimits restricts the size of the name/value header
+// blocks a connection will accept. The limits are enforced
+// as the block is decompressed. A zero value means that
+// there is no limit, other than the maximum frame size.
+type HeaderLimits struct {
+	MaxBytes       int // decompressed size of a header block.
+	MaxHeaders     int // number of name/value pairs in a header block.
+	MaxNameLength  int // length of a header name.
+	MaxValueLength int // length of a header's values.
+
+	// MaxViolations is the number of header blocks over the
+	// limits that a connection will accept before it is ended
+	// with a GOAWAY.
+	MaxViolations int
+}
+
+// DefaultHeaderLimits are used by new connections. Servers
+// use http.Server.MaxHeaderBytes instead of MaxBytes, if set.
+var DefaultHeaderLimits = HeaderLimits{
+	MaxBytes:      http.DefaultMaxHeaderBytes,
+	MaxHeaders:    1000,
+	MaxViolations: 3,
+}
+
+// headerBombFactor is how far beyond MaxBytes a header block
+// will be decompressed and discarded before the block is
+// treated as an attack on the connection.
+const headerBombFactor = 8
+
 // Decompressor is used to decompress name/value header blocks.
 // Decompressors retain their state, so a single Decompressor
 // should be used for each direction of a particular connection.
@@ -32,13 +62,23 @@ type decompressor struct {
 	in      *bytes.Buffer
 	out     io.ReadCloser
 	version uint16
+	limits  HeaderLimits
 }
 
 // NewDecompressor is used to create a new decompressor.
-// It takes the SPDY version to use.
+// It takes the SPDY version to use, and applies the
+// DefaultHeaderLimits.
 func NewDecompressor(version uint16) Decompressor {
+	return NewDecompressorWithLimits(version, DefaultHeaderLimits)
+}
+
+// NewDecompressorWithLimits is used to create a new
+// decompressor with the given header limits. It takes
+// the SPDY version to use.
+func NewDecompressorWithLimits(version uint16, limits HeaderLimits) Decompressor {
 	out := new(decompressor)
 	out.version = version
+	out.limits = limits
 	return out
 }
 
@@ -99,8 +139,39 @@ func (d *decompressor) Decompress(data []byte) (headers http.Header, err error)
 	}
 	numNameValuePairs := bytesToInt(pairs)
 
+	// Header blocks over the limits are still read in full,
+	// so that the compression state stays in sync with the
+	// other endpoint, but the headers are discarded. Blocks
+	// far beyond the limits are treated as an attack.
+	limits := d.limits
+	var limitErr *HeaderLimitError
+	exceed := func(reason string) {
+		if limitErr == nil {
+			limitErr = &HeaderLimitError{reason}
+		}
+	}
+	budget := MAX_FRAME_SIZE
+	if limits.MaxBytes > 0 && limits.MaxBytes*headerBombFactor < budget {
+		budget = limits.MaxBytes * headerBombFactor
+	}
+
+	// read returns n bytes of the block, or
+	// discards them if over the limits.
+	read := func(n int) ([]byte, error) {
+		if limitErr == nil {
+			return ReadExactly(d.out, n)
+		}
+		_, err := io.CopyN(ioutil.Discard, d.out, int64(n))
+		return nil, err
+	}
+
+	if limits.MaxHeaders > 0 && numNameValuePairs > limits.MaxHeaders {
+		exceed("too many headers")
+	}
+
 	headers = make(http.Header)
 	bounds := MAX_FRAME_SIZE - 12 // Maximum frame size minus maximum non-headers data (SYN_STREAM)
+	total := size
 	for i := 0; i < numNameValuePairs; i++ {
 		var nameLength, valueLength int
 
@@ -118,8 +189,19 @@ func (d *decompressor) Decompress(data []byte) (headers http.Header, err error)
 		}
 		bounds -= nameLength
 
+		if limits.MaxNameLength > 0 && nameLength > limits.MaxNameLength {
+			exceed("header name too long")
+		}
+		total += size + nameLength
+		if limits.MaxBytes > 0 && total > limits.MaxBytes {
+			exceed("header block too large")
+		}
+		if total > budget {
+			return nil, ErrHeaderBlockTooLarge
+		}
+
 		// Get the name.
-		name, err := ReadExactly(d.out, nameLength)
+		name, err := read(nameLength)
 		if err != nil {
 			return nil, err
 		}
@@ -138,11 +220,25 @@ func (d *decompressor) Decompress(data []byte) (headers http.Header, err error)
 		}
 		bounds -= valueLength
 
+		if limits.MaxValueLength > 0 && valueLength > limits.MaxValueLength {
+			exceed("header value too long")
+		}
+		total += size + valueLength
+		if limits.MaxBytes > 0 && total > limits.MaxBytes {
+			exceed("header block too large")
+		}
+		if total > budget {
+			return nil, ErrHeaderBlockTooLarge
+		}
+
 		// Get the values.
-		values, err := ReadExactly(d.out, valueLength)
+		values, err := read(valueLength)
 		if err != nil {
 			return nil, err
 		}
+		if limitErr != nil {
+			continue
+		}
 
 		// Split the value on null boundaries.
 		for _, value := range bytes.Split(values, []byte{'\x00'}) {
@@ -150,6 +246,10 @@ func (d *decompressor) Decompress(data []byte) (headers http.Header, err error)
 		}
 	}
 
+	if limitErr != nil {
+		return nil, limitErr
+	}
+
 	return headers, nil
 }
 
@@ -0,0 +1,53 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+func TestDecompressorLimits(t *testing.T) {
+	compressor := common.NewCompressor(3)
+	decompressor := common.NewDecompressorWithLimits(3, common.HeaderLimits{MaxBytes: 1024})
+
+	small := http.Header{"X-Test": {"small"}}
+	large := http.Header{"X-Test": {strings.Repeat("a", 2048)}}
+	bomb := http.Header{"X-Test": {strings.Repeat("a", 16*1024)}}
+
+	data, err := compressor.Compress(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decompressor.Decompress(data); err == nil {
+		t.Fatal("Expected large header block to be rejected.")
+	} else if _, ok := err.(*common.HeaderLimitError); !ok {
+		t.Fatalf("Expected a HeaderLimitError. Got %v", err)
+	}
+
+	// The compression state should still be in sync.
+	data, err = compressor.Compress(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := decompressor.Decompress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := header.Get("X-Test"); got != "small" {
+		t.Errorf("Expected small. Got %q", got)
+	}
+
+	data, err = compressor.Compress(bomb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decompressor.Decompress(data); err != common.ErrHeaderBlockTooLarge {
+		t.Errorf("Expected ErrHeaderBlockTooLarge. Got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+// Config holds the settings used by a server's SPDY
+// connections. A Config should be created with
+// DefaultConfig, and modified before the server begins
+// serving. It must not be modified afterwards.
+type Config struct {
+	// AbusePolicy rate-limits PING, SETTINGS, SYN_STREAM
+	// and RST_STREAM frames from the other endpoint, both
+	// per connection and per remote IP. Connections that
+	// exceed the limits are ended with a GOAWAY. If nil,
+	// no abuse protection is performed.
+	AbusePolicy *AbusePolicy
+
+	// PushPreloads enables automatic server push of the
+	// resources listed in responses' Link headers with
+	// rel=preload, such as
+	//
+	//      Link: </style.css>; rel=preload; as=style
+	//
+	// Each same-origin resource is pushed with a GET request
+	// served by the same handler, before the response is
+	// sent. Links marked nopush are skipped, and each
+	// resource is pushed at most once per connection. By
+	// default, preloads are not pushed.
+	PushPreloads bool
+
+	// AccessLogger is given the details of each stream
+	// served, once it has ended. This includes the stream's
+	// connection, version, priority, and how it ended.
+	// Pushed streams are included. NewAccessLogger can be
+	// used to write each stream's details to an io.Writer,
+	// such as os.Stderr. If nil, no access logging is
+	// performed.
+	AccessLogger AccessLogger
+
+	// PushBudget limits the server pushes that each
+	// connection sends, both in total and for each request,
+	// by number and size. Once the budget is spent, Push
+	// returns a *PushBudgetError. Setting MaxRefused also
+	// disables pushes on connections whose clients refuse
+	// or cancel that many.
+	PushBudget PushBudget
+
+	// MaxStreamBuffer limits the data, in bytes, that each
+	// SPDY/3 stream buffers while waiting for the other
+	// endpoint's flow control window to grow. Once the
+	// buffer is full, or the memory budget is exhausted,
+	// writes to the stream block until the window grows,
+	// the stream closes, or the write deadline passes. A
+	// negative limit buffers without any limit other than
+	// the memory budget.
+	MaxStreamBuffer int
+
+	// MemoryBudget accounts for the stream data that
+	// connections buffer in memory, and may be shared by
+	// several servers. As usage nears its limit,
+	// connections stop granting WINDOW_UPDATEs and refuse
+	// new streams, until buffered data has been consumed
+	// or sent. If nil, DefaultMemoryBudget is used.
+	MemoryBudget *MemoryBudget
+
+	// Scheduler is called to create the Scheduler for each
+	// SPDY/3 connection, which chooses how the connection's
+	// bandwidth is shared between streams. Control frames
+	// are always sent before stream frames. NewWFQScheduler,
+	// NewPriorityScheduler and NewDRRScheduler are provided.
+	// If nil, DefaultScheduler is used.
+	Scheduler func() Scheduler
+}
+
+// DefaultConfig returns a new Config using the package
+// defaults, such as DefaultAbusePolicy. Connections
+// created without a Config use these defaults.
+func DefaultConfig() *Config {
+	return &Config{
+		AbusePolicy:     DefaultAbusePolicy,
+		PushBudget:      DefaultPushBudget,
+		MaxStreamBuffer: MaxStreamBuffer,
+		MemoryBudget:    DefaultMemoryBudget,
+		Scheduler:       DefaultScheduler,
+	}
+}
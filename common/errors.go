@@ -7,6 +7,9 @@ package common
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"runtime"
 )
 
 // MaxBenignErrors is the maximum number of minor errors each
@@ -19,12 +22,42 @@ import (
 // another implementation, set MaxBenignErrors to 1 or higher.
 var MaxBenignErrors = 0
 
+// HandlerPanicHook, if set, is called when a handler panics,
+// with the request being served, the value passed to panic,
+// and a stack trace. Panics with http.ErrAbortHandler are
+// not reported.
+var HandlerPanicHook func(r *http.Request, v interface{}, stack []byte)
+
+// ReportHandlerPanic logs a panic in the handler for the
+// given stream, along with a stack trace, and passes it
+// to HandlerPanicHook, if set. It should be called from
+// the deferred function that recovered the panic.
+func ReportHandlerPanic(streamID StreamID, r *http.Request, v interface{}) {
+	if v == http.ErrAbortHandler {
+		return
+	}
+
+	stack := make([]byte, 64<<10)
+	stack = stack[:runtime.Stack(stack, false)]
+	log.Printf("Error: Handler for stream %d panicked: %v\n%s", streamID, v, stack)
+
+	if hook := HandlerPanicHook; hook != nil {
+		hook(r, v, stack)
+	}
+}
+
 var (
 	ErrConnNil        = errors.New("Error: Connection is nil.")
 	ErrGoaway         = errors.New("Error: GOAWAY received.")
 	ErrNoFlowControl  = errors.New("Error: This connection does not use flow control.")
 	ErrConnectFail    = errors.New("Error: Failed to connect.")
 	ErrInvalidVersion = errors.New("Error: Invalid SPDY version.")
+	ErrStreamClosed   = errors.New("Error: Stream closed.")
+
+	// ErrHeaderBlockTooLarge indicates that a header block was
+	// so far beyond the HeaderLimits that decompression was
+	// abandoned, leaving the connection unusable.
+	ErrHeaderBlockTooLarge = errors.New("Error: Header block far exceeds the size limit.")
 
 	// ErrNotSPDY indicates that a SPDY-specific feature was attempted
 	// with a ResponseWriter using a non-SPDY connection.
@@ -35,6 +68,39 @@ var (
 	ErrNotConnected = errors.New("Error: Not connected to given server.")
 )
 
+// HeaderLimitError is returned when a header block exceeds
+// the connection's HeaderLimits. The block has still been
+// decompressed in full, so the connection can continue.
+type HeaderLimitError struct {
+	Reason string
+}
+
+func (e *HeaderLimitError) Error() string {
+	return fmt.Sprintf("Error: Header block exceeds limits: %s.", e.Reason)
+}
+
+// StreamResetError is returned when using a stream that
+// the other endpoint has reset with RST_STREAM, such as a
+// push that the client has cancelled or refused.
+type StreamResetError struct {
+	StreamID StreamID
+	Status   StatusCode
+}
+
+func (e *StreamResetError) Error() string {
+	return fmt.Sprintf("Error: Stream %d was reset by the other endpoint with %s.", e.StreamID, e.Status)
+}
+
+// ErrTimeout is returned by streams used as a net.Conn
+// once a read or write deadline has passed.
+var ErrTimeout net.Error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "Error: I/O timeout." }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
 type incorrectDataLength struct {
 	got, expected int
 }
@@ -0,0 +1,31 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import "context"
+
+type flowControlKey struct{}
+
+// WithFlowControl returns a copy of ctx which directs the
+// connection to regrow the receive window of a request's
+// stream using f, rather than the connection's FlowControl.
+// For example, a bulk download can be given a large window
+// without affecting other requests on the same connection:
+//
+//	req = req.WithContext(common.WithFlowControl(req.Context(), f))
+//
+// The stream's initial window size is still that of the
+// connection, and the SPDY/3.1 session window is still
+// managed by the connection's FlowControl.
+func WithFlowControl(ctx context.Context, f FlowControl) context.Context {
+	return context.WithValue(ctx, flowControlKey{}, f)
+}
+
+// FlowControlFromContext returns the FlowControl given
+// to WithFlowControl, or nil if there is none.
+func FlowControlFromContext(ctx context.Context) FlowControl {
+	f, _ := ctx.Value(flowControlKey{}).(FlowControl)
+	return f
+}
@@ -0,0 +1,85 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+)
+
+// HostRouter is implemented by server Handlers which serve
+// several hosts, each with its own Handler and certificate,
+// such as spdy.VirtualHosts. Each stream is dispatched to
+// the Handler for its :host, and streams to hosts that are
+// not covered by the certificate negotiated for the
+// connection are refused.
+type HostRouter interface {
+	http.Handler
+
+	// HostHandler returns the Handler for the given
+	// host, or nil if the host is not served.
+	HostHandler(host string) http.Handler
+}
+
+// NegotiatedCertificate returns the certificate that the
+// given TLS config presents to clients which request the
+// given server name, using SNI. If the certificate cannot
+// be determined, NegotiatedCertificate returns nil.
+func NegotiatedCertificate(config *tls.Config, serverName string) *x509.Certificate {
+	if config == nil {
+		return nil
+	}
+
+	if config.GetCertificate != nil {
+		cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			return nil
+		}
+		if cert != nil {
+			return leafCertificate(cert)
+		}
+	}
+
+	if len(config.Certificates) == 0 {
+		return nil
+	}
+	if len(config.Certificates) > 1 && serverName != "" {
+		for i := range config.Certificates {
+			leaf := leafCertificate(&config.Certificates[i])
+			if leaf != nil && leaf.VerifyHostname(serverName) == nil {
+				return leaf
+			}
+		}
+	}
+
+	return leafCertificate(&config.Certificates[0])
+}
+
+// leafCertificate returns the parsed leaf
+// of the given certificate chain.
+func leafCertificate(cert *tls.Certificate) *x509.Certificate {
+	if cert.Leaf != nil {
+		return cert.Leaf
+	}
+	if len(cert.Certificate) == 0 {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
+
+// CoversHost returns whether the given certificate is
+// valid for host, which may include a port.
+func CoversHost(cert *x509.Certificate, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host != "" && cert.VerifyHostname(host) == nil
+}
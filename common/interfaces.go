@@ -5,10 +5,12 @@
 package common
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"time"
 )
 
 // Connection represents a SPDY connection. The connection should
@@ -44,6 +46,17 @@ type PushStream interface {
 	// push stream once writing
 	// has finished.
 	Finish()
+
+	// Context returns a context that
+	// is done once the push has ended,
+	// such as when the client cancels
+	// or refuses it.
+	Context() context.Context
+
+	// Err returns a *StreamResetError
+	// if the client has reset the push,
+	// or nil otherwise.
+	Err() error
 }
 
 // PriorityStream represents a SPDY stream with a priority.
@@ -88,6 +101,13 @@ type Pusher interface {
 	Push(url string, origin Stream) (PushStream, error)
 }
 
+// StreamHijacker represents a stream which can be
+// taken over by the handler, for use as a full-duplex
+// byte stream.
+type StreamHijacker interface {
+	HijackStream() (io.ReadWriteCloser, error)
+}
+
 // SetFlowController represents a connection
 // which can have its flow control mechanism
 // customised.
@@ -146,3 +166,12 @@ type FlowControl interface {
 	InitialWindowSize() uint32
 	ReceiveData(streamID StreamID, initialWindowSize uint32, newWindowSize int64) (deltaSize uint32)
 }
+
+// RTTObserver can be implemented by a FlowControl which
+// uses the connection's round-trip time. The connection
+// measures the round-trip time with PINGs while data is
+// being received, and passes each measurement to
+// ObserveRTT.
+type RTTObserver interface {
+	ObserveRTT(rtt time.Duration)
+}
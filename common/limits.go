@@ -8,6 +8,12 @@ import (
 	"sync"
 )
 
+// MaxStreamBuffer is the amount of data, in bytes, that
+// each stream on connections created without a Config
+// will buffer while waiting for the other endpoint's
+// transfer window to grow.
+var MaxStreamBuffer = 64 << 10
+
 // StreamLimit is used to add and enforce
 // a limit on the number of concurrently
 // active streams.
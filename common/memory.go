@@ -0,0 +1,188 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"sync"
+)
+
+// MemoryBudget accounts for the stream data buffered in
+// memory, so that it can be bounded across connections.
+// Request bodies, data waiting for a transfer window and
+// responses stored for clients all draw from it.
+//
+// Once usage nears the limit, connections stop regrowing
+// receive windows, so the other endpoint must wait before
+// sending more data, and refuse new streams with
+// REFUSED_STREAM. Windows are regrown once usage falls.
+type MemoryBudget struct {
+	lock     sync.Mutex
+	limit    int64
+	used     int64
+	peak     int64
+	withheld uint64
+	refused  uint64
+	relief   chan struct{} // closed once pressure eases.
+}
+
+// MemoryStats describes the usage of a MemoryBudget.
+type MemoryStats struct {
+	Limit    int64  // limit in bytes, or 0 for no limit.
+	Used     int64  // bytes currently buffered.
+	Peak     int64  // most bytes buffered at once.
+	Withheld uint64 // WINDOW_UPDATEs deferred under pressure.
+	Refused  uint64 // streams refused under pressure.
+}
+
+// DefaultMemoryBudget is shared by all connections created
+// without a Config, or whose Config has no MemoryBudget,
+// and by the buffers of client responses. By default,
+// memory use is measured, but not limited.
+var DefaultMemoryBudget = NewMemoryBudget(0)
+
+// NewMemoryBudget produces a MemoryBudget with the given
+// limit in bytes. A limit of 0 means there is no limit.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	out := new(MemoryBudget)
+	out.limit = limit
+	return out
+}
+
+// SetLimit is used to modify the limit. A limit
+// of 0 disables the limit.
+func (m *MemoryBudget) SetLimit(limit int64) {
+	m.lock.Lock()
+	m.limit = limit
+	m.relieve()
+	m.lock.Unlock()
+}
+
+// Limit returns the current limit.
+func (m *MemoryBudget) Limit() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.limit
+}
+
+// Acquire records that n bytes have been buffered. This
+// is used for data which has already been received, so
+// it is counted even if it exceeds the limit.
+func (m *MemoryBudget) Acquire(n int) {
+	if n <= 0 {
+		return
+	}
+
+	m.lock.Lock()
+	m.used += int64(n)
+	if m.used > m.peak {
+		m.peak = m.used
+	}
+	m.lock.Unlock()
+}
+
+// Reserve is called before n bytes are buffered, and
+// returns a bool indicating whether the limit allows
+// them. If so, they are counted as with Acquire.
+func (m *MemoryBudget) Reserve(n int) bool {
+	if n <= 0 {
+		return true
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.limit > 0 && m.used+int64(n) > m.limit {
+		return false
+	}
+	m.used += int64(n)
+	if m.used > m.peak {
+		m.peak = m.used
+	}
+	return true
+}
+
+// Release records that n buffered bytes
+// have been sent, consumed or discarded.
+func (m *MemoryBudget) Release(n int) {
+	if n <= 0 {
+		return
+	}
+
+	m.lock.Lock()
+	m.used -= int64(n)
+	if m.used < 0 {
+		m.used = 0
+	}
+	m.relieve()
+	m.lock.Unlock()
+}
+
+// Pressure indicates whether usage is near the
+// limit, which is taken to be within an eighth
+// of it. This can be used as the Pressure of an
+// AutoFlowControl.
+func (m *MemoryBudget) Pressure() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.pressure()
+}
+
+func (m *MemoryBudget) pressure() bool {
+	return m.limit > 0 && m.used >= m.limit-m.limit/8
+}
+
+// Relieved returns a channel which is closed once
+// usage is no longer near the limit.
+func (m *MemoryBudget) Relieved() <-chan struct{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.relief == nil {
+		m.relief = make(chan struct{})
+	}
+	out := m.relief
+	m.relieve()
+	return out
+}
+
+// relieve closes the relief channel if
+// there is no pressure. The lock must
+// be held.
+func (m *MemoryBudget) relieve() {
+	if m.relief != nil && !m.pressure() {
+		close(m.relief)
+		m.relief = nil
+	}
+}
+
+// Withheld records that a WINDOW_UPDATE
+// was deferred because of pressure.
+func (m *MemoryBudget) Withheld() {
+	m.lock.Lock()
+	m.withheld++
+	m.lock.Unlock()
+}
+
+// Refused records that a stream was
+// refused because of pressure.
+func (m *MemoryBudget) Refused() {
+	m.lock.Lock()
+	m.refused++
+	m.lock.Unlock()
+}
+
+// Stats returns the current usage.
+func (m *MemoryBudget) Stats() MemoryStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return MemoryStats{
+		Limit:    m.limit,
+		Used:     m.used,
+		Peak:     m.peak,
+		Withheld: m.withheld,
+		Refused:  m.refused,
+	}
+}
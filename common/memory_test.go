@@ -0,0 +1,35 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common_test
+
+import (
+	"testing"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	budget := common.NewMemoryBudget(800)
+	if !budget.Reserve(600) || budget.Pressure() {
+		t.Fatal("Expected 600 of 800 bytes to be reserved without pressure.")
+	}
+	if budget.Reserve(300) {
+		t.Fatal("Expected reservation beyond the limit to fail.")
+	}
+	budget.Acquire(150)
+	if !budget.Pressure() {
+		t.Fatal("Expected pressure near the limit.")
+	}
+	relief := budget.Relieved()
+	budget.Release(100)
+	select {
+	case <-relief:
+	default:
+		t.Fatal("Expected relief once usage fell.")
+	}
+	if stats := budget.Stats(); stats.Used != 650 || stats.Peak != 750 {
+		t.Errorf("Expected 650 bytes used, peaking at 750. Got %+v", stats)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// Pipe is used to pass data received on a stream
+// to a reader as it arrives. Writes never block,
+// and are buffered until read. Reads block until
+// data is available or the pipe has been closed
+// by the writer.
+type Pipe struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	err    error         // returned by Read once buf is empty.
+	closed bool          // the reader has closed the pipe.
+	memory *MemoryBudget // accounts for buf.
+
+	deadline time.Time   // Read fails with ErrTimeout after this.
+	timer    *time.Timer // wakes blocked reads at the deadline.
+}
+
+func NewPipe() *Pipe {
+	return NewPipeWithBudget(DefaultMemoryBudget)
+}
+
+// NewPipeWithBudget produces a Pipe whose
+// buffered data draws from memory.
+func NewPipeWithBudget(memory *MemoryBudget) *Pipe {
+	out := new(Pipe)
+	out.cond = sync.NewCond(&out.lock)
+	out.memory = memory
+	return out
+}
+
+// Read reads data from the pipe, blocking until
+// data is available or the writer has closed
+// the pipe.
+func (p *Pipe) Read(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for p.buf.Len() == 0 && p.err == nil {
+		if !p.deadline.IsZero() && !time.Now().Before(p.deadline) {
+			return 0, ErrTimeout
+		}
+		p.cond.Wait()
+	}
+
+	if p.buf.Len() == 0 {
+		return 0, p.err
+	}
+
+	n, err := p.buf.Read(b)
+	p.memory.Release(n)
+	return n, err
+}
+
+// SetReadDeadline sets the time after which
+// blocked and future reads will fail with
+// ErrTimeout. A zero value for t means that
+// reads will not time out.
+func (p *Pipe) SetReadDeadline(t time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.deadline = t
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	if !t.IsZero() {
+		p.timer = time.AfterFunc(time.Until(t), func() {
+			p.lock.Lock()
+			p.cond.Broadcast()
+			p.lock.Unlock()
+		})
+	}
+	p.cond.Broadcast()
+}
+
+// Write adds data to the pipe. Data written
+// after either end has closed the pipe is
+// discarded.
+func (p *Pipe) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed || p.err != nil {
+		return 0, ErrStreamClosed
+	}
+
+	n, err := p.buf.Write(b)
+	p.memory.Acquire(n)
+	p.cond.Broadcast()
+	return n, err
+}
+
+// CloseWithError is used by the writer to close
+// the pipe. Once any buffered data has been read,
+// Read will return err, or io.EOF if err is nil.
+func (p *Pipe) CloseWithError(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+
+	p.lock.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.cond.Broadcast()
+	p.lock.Unlock()
+}
+
+// Close is used by the reader to close the pipe,
+// discarding any buffered data.
+func (p *Pipe) Close() error {
+	p.Discard()
+	return nil
+}
+
+// Discard is used by the reader to close the pipe,
+// discarding any buffered data. It returns the
+// number of bytes discarded.
+func (p *Pipe) Discard() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	n := p.buf.Len()
+	p.closed = true
+	p.buf.Reset()
+	p.memory.Release(n)
+	if p.err == nil {
+		p.err = io.EOF
+	}
+	p.cond.Broadcast()
+	return n
+}
+
+// Len returns the number of bytes buffered.
+func (p *Pipe) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.buf.Len()
+}
@@ -0,0 +1,145 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// preloadHeaders are copied from the original request to
+// the requests synthesized for preloaded resources.
+var preloadHeaders = []string{
+	"Accept-Encoding",
+	"Accept-Language",
+	"Authorization",
+	"Cache-Control",
+	"Cookie",
+	"User-Agent",
+}
+
+// PreloadLinks returns the absolute URLs of the resources
+// listed in the given response header's Link headers with
+// rel=preload. Links marked nopush, and those not on the
+// same origin as the given URL, are skipped.
+func PreloadLinks(header http.Header, origin *url.URL) []string {
+	var out []string
+	for _, value := range header["Link"] {
+		for _, link := range splitLinks(value) {
+			target, params := parseLink(link)
+			if target == "" || params["nopush"] {
+				continue
+			}
+			if !params["rel=preload"] {
+				continue
+			}
+
+			u, err := origin.Parse(target)
+			if err != nil || u.Scheme != origin.Scheme || u.Host != origin.Host {
+				continue
+			}
+			u.Fragment = ""
+			out = append(out, u.String())
+		}
+	}
+	return out
+}
+
+// splitLinks splits a Link header value into its links,
+// ignoring commas inside URLs and quoted strings.
+func splitLinks(value string) []string {
+	var out []string
+	inURL, inQuote := false, false
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case inQuote:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inQuote = false
+			}
+		case c == '"':
+			inQuote = true
+		case c == '<':
+			inURL = true
+		case c == '>':
+			inURL = false
+		case c == ',' && !inURL:
+			out = append(out, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, value[start:])
+}
+
+// parseLink returns a link's target and its parameters.
+// Each parameter is lower case, and rel parameters are
+// split into one "rel=<type>" parameter per type.
+func parseLink(link string) (string, map[string]bool) {
+	link = strings.TrimSpace(link)
+	if !strings.HasPrefix(link, "<") {
+		return "", nil
+	}
+	end := strings.Index(link, ">")
+	if end < 0 {
+		return "", nil
+	}
+
+	params := make(map[string]bool)
+	for _, param := range strings.Split(link[end+1:], ";") {
+		param = strings.ToLower(strings.TrimSpace(param))
+		if param == "" {
+			continue
+		}
+		name, value := param, ""
+		if i := strings.Index(param, "="); i >= 0 {
+			name = strings.TrimSpace(param[:i])
+			value = strings.Trim(strings.TrimSpace(param[i+1:]), `"`)
+		}
+		if name == "rel" {
+			for _, rel := range strings.Fields(value) {
+				params["rel="+rel] = true
+			}
+			continue
+		}
+		params[name] = true
+	}
+
+	return strings.TrimSpace(link[1:end]), params
+}
+
+// PreloadRequest synthesizes a GET request for the
+// resource at target, as if it had been requested
+// by the client that sent the original request.
+func PreloadRequest(origin *http.Request, target string) (*http.Request, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header)
+	for _, name := range preloadHeaders {
+		if values := origin.Header[name]; len(values) > 0 {
+			header[name] = append([]string(nil), values...)
+		}
+	}
+
+	out := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      origin.Proto,
+		ProtoMajor: origin.ProtoMajor,
+		ProtoMinor: origin.ProtoMinor,
+		RemoteAddr: origin.RemoteAddr,
+		Header:     header,
+		Body:       http.NoBody,
+		Host:       u.Host,
+		RequestURI: u.RequestURI(),
+		TLS:        origin.TLS,
+	}
+	return out, nil
+}
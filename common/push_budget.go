@@ -0,0 +1,166 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"fmt"
+	"sync"
+)
+
+// PushBudget limits the server pushes sent on each
+// connection, and for each request. A zero field
+// means that there is no limit.
+//
+// Byte limits are checked when each push starts, and
+// as each push is written. A write that would exceed a
+// byte limit sends what the limit allows, and returns a
+// *PushBudgetError.
+type PushBudget struct {
+	ConnStreams    int   // pushes per connection.
+	ConnBytes      int64 // pushed bytes per connection.
+	RequestStreams int   // pushes per originating request.
+	RequestBytes   int64 // pushed bytes per originating request.
+
+	// MaxRefused is the number of pushes that the client
+	// may refuse or cancel before pushes are disabled for
+	// the rest of the connection.
+	MaxRefused int
+}
+
+// DefaultPushBudget is used by server connections created
+// without a Config. By default, pushes are not limited.
+var DefaultPushBudget PushBudget
+
+// PushBudgetError is returned by Push when a push would
+// exceed the connection's PushBudget, or once pushes have
+// been disabled because the client refused too many. It
+// is also returned by a PushStream's Write once a byte
+// limit has been reached.
+type PushBudgetError struct {
+	Reason string
+}
+
+func (e *PushBudgetError) Error() string {
+	return fmt.Sprintf("Error: Push budget exceeded: %s.", e.Reason)
+}
+
+// PushAccount tracks a connection's pushes
+// against its PushBudget.
+type PushAccount struct {
+	budget   PushBudget
+	lock     sync.Mutex
+	streams  int
+	bytes    int64
+	refused  int
+	requests map[StreamID]*pushUsage
+}
+
+// pushUsage is the pushes sent
+// for one originating request.
+type pushUsage struct {
+	streams int
+	bytes   int64
+}
+
+// NewPushAccount produces a PushAccount
+// enforcing the given budget.
+func NewPushAccount(budget PushBudget) *PushAccount {
+	out := new(PushAccount)
+	out.budget = budget
+	out.requests = make(map[StreamID]*pushUsage)
+	return out
+}
+
+// Start is called when a push is to be sent for the
+// request on the given stream, and returns an error
+// if the push would exceed the budget. Otherwise, the
+// push is counted.
+func (a *PushAccount) Start(origin StreamID) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	b := &a.budget
+	usage := a.requests[origin]
+	if usage == nil {
+		usage = new(pushUsage)
+	}
+
+	switch {
+	case b.MaxRefused > 0 && a.refused >= b.MaxRefused:
+		return &PushBudgetError{"pushes disabled after repeated refusals"}
+	case b.ConnStreams > 0 && a.streams >= b.ConnStreams:
+		return &PushBudgetError{"too many pushes on connection"}
+	case b.ConnBytes > 0 && a.bytes >= b.ConnBytes:
+		return &PushBudgetError{"too many bytes pushed on connection"}
+	case b.RequestStreams > 0 && usage.streams >= b.RequestStreams:
+		return &PushBudgetError{"too many pushes for request"}
+	case b.RequestBytes > 0 && usage.bytes >= b.RequestBytes:
+		return &PushBudgetError{"too many bytes pushed for request"}
+	}
+
+	a.streams++
+	usage.streams++
+	a.requests[origin] = usage
+	return nil
+}
+
+// Cancel releases a push counted by Start
+// which was not sent after all.
+func (a *PushAccount) Cancel(origin StreamID) {
+	a.lock.Lock()
+	a.streams--
+	if usage := a.requests[origin]; usage != nil {
+		usage.streams--
+	}
+	a.lock.Unlock()
+}
+
+// Reserve is called before n bytes are pushed for the
+// request on the given stream. It counts and returns as
+// many of the bytes as the budget allows, along with an
+// error if that is fewer than n.
+func (a *PushAccount) Reserve(origin StreamID, n int) (int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	b := &a.budget
+	usage := a.requests[origin]
+	allowed := int64(n)
+	var err error
+	if b.ConnBytes > 0 && a.bytes+allowed > b.ConnBytes {
+		allowed = b.ConnBytes - a.bytes
+		err = &PushBudgetError{"too many bytes pushed on connection"}
+	}
+	if usage != nil && b.RequestBytes > 0 && usage.bytes+allowed > b.RequestBytes {
+		allowed = b.RequestBytes - usage.bytes
+		err = &PushBudgetError{"too many bytes pushed for request"}
+	}
+	if allowed < 0 {
+		allowed = 0
+	}
+
+	a.bytes += allowed
+	if usage != nil {
+		usage.bytes += allowed
+	}
+	return int(allowed), err
+}
+
+// Refused records that the client refused
+// or cancelled a push.
+func (a *PushAccount) Refused() {
+	a.lock.Lock()
+	a.refused++
+	a.lock.Unlock()
+}
+
+// Finish is called once the request on the
+// given stream has finished, releasing its
+// state.
+func (a *PushAccount) Finish(origin StreamID) {
+	a.lock.Lock()
+	delete(a.requests, origin)
+	a.lock.Unlock()
+}
@@ -0,0 +1,60 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common_test
+
+import (
+	"testing"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+func TestPushAccountBytes(t *testing.T) {
+	account := common.NewPushAccount(common.PushBudget{ConnBytes: 15, RequestBytes: 10})
+	if err := account.Start(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes are cut short at the request's limit.
+	tests := []struct {
+		origin  common.StreamID
+		n       int
+		allowed int
+		err     bool
+	}{
+		{1, 6, 6, false},
+		{1, 6, 4, true},
+		{1, 1, 0, true},
+	}
+	for i, test := range tests {
+		n, err := account.Reserve(test.origin, test.n)
+		if _, ok := err.(*common.PushBudgetError); n != test.allowed || ok != test.err {
+			t.Errorf("%d: Expected %d bytes (error %v). Got %d bytes, %v", i, test.allowed, test.err, n, err)
+		}
+	}
+
+	// Then at the connection's limit.
+	if err := account.Start(3); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := account.Reserve(3, 8); n != 5 || err == nil {
+		t.Errorf("Expected 5 bytes and an error. Got %d bytes, %v", n, err)
+	}
+}
+
+func TestPushAccountCancel(t *testing.T) {
+	account := common.NewPushAccount(common.PushBudget{ConnStreams: 1})
+	if err := account.Start(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := account.Start(1); err == nil {
+		t.Fatal("Expected push budget error.")
+	}
+
+	// A cancelled push no longer counts.
+	account.Cancel(1)
+	if err := account.Start(1); err != nil {
+		t.Errorf("Expected push to be allowed once cancelled. Got %v", err)
+	}
+}
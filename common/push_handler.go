@@ -0,0 +1,212 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type associatedRequestKey struct{}
+
+// ContextWithAssociatedRequest returns a copy of ctx carrying
+// the request whose stream a server push is associated with.
+// It is used by connections when creating pushed requests.
+func ContextWithAssociatedRequest(ctx context.Context, request *http.Request) context.Context {
+	return context.WithValue(ctx, associatedRequestKey{}, request)
+}
+
+// AssociatedRequest returns the request whose stream the
+// given pushed request is associated with, or nil if it is
+// not known.
+func AssociatedRequest(pushed *http.Request) *http.Request {
+	request, _ := pushed.Context().Value(associatedRequestKey{}).(*http.Request)
+	return request
+}
+
+type pushReceiverKey struct{}
+
+// WithPushReceiver returns a copy of ctx which directs the
+// server pushes associated with a request using the context
+// to receiver, rather than to the connection's PushReceiver.
+// For example:
+//
+//	req = req.WithContext(common.WithPushReceiver(req.Context(), receiver))
+//
+// Pushes are refused once the request's response has
+// been received in full.
+func WithPushReceiver(ctx context.Context, receiver Receiver) context.Context {
+	return context.WithValue(ctx, pushReceiverKey{}, receiver)
+}
+
+// PushReceiverFromContext returns the Receiver given to
+// WithPushReceiver, or nil if there is none.
+func PushReceiverFromContext(ctx context.Context) Receiver {
+	receiver, _ := ctx.Value(pushReceiverKey{}).(Receiver)
+	return receiver
+}
+
+// PushHandler is a Receiver which delivers each server push
+// as a request and a response with a streaming body, rather
+// than as separate headers and data. It can be used as a
+// Conn's or Transport's PushReceiver.
+//
+// Each pushed request's context carries the request that the
+// push is associated with, which is given by AssociatedRequest.
+// The context is done if the push is reset or the connection
+// closes.
+type PushHandler struct {
+	// Accept decides whether a push is received. If Accept
+	// is nil, all pushes are received.
+	Accept func(pushed *http.Request) bool
+
+	// Handle is called in a new goroutine for each push
+	// received, once the response headers have arrived,
+	// either in a HEADERS frame or with the first data.
+	// The response's Body returns data as it arrives, and
+	// must be closed. Headers received after the response
+	// headers are added to the response's Trailer once the
+	// Body has been read in full.
+	Handle func(pushed *http.Request, response *http.Response)
+
+	lock   sync.Mutex
+	pushes map[*http.Request]*pushedResponse
+}
+
+// pushedResponse is the state of a push
+// received by a PushHandler.
+type pushedResponse struct {
+	promised bool        // the SYN_STREAM's headers have been received.
+	header   http.Header // headers received before the response starts.
+	trailer  http.Header // headers received since, added to the Trailer at the end.
+	response *http.Response
+	body     *Pipe
+}
+
+func (p *PushHandler) ReceiveRequest(request *http.Request) bool {
+	if p.Accept != nil && !p.Accept(request) {
+		return false
+	}
+
+	push := &pushedResponse{header: make(http.Header), trailer: make(http.Header), body: NewPipe()}
+	p.lock.Lock()
+	if p.pushes == nil {
+		p.pushes = make(map[*http.Request]*pushedResponse)
+	}
+	p.pushes[request] = push
+	p.lock.Unlock()
+
+	go p.watch(request, push)
+	return true
+}
+
+func (p *PushHandler) ReceiveHeader(request *http.Request, header http.Header) {
+	push := p.push(request)
+	if push == nil {
+		return
+	}
+	if push.response != nil {
+		UpdateHeader(push.trailer, header)
+		return
+	}
+
+	// The SYN_STREAM may be followed by the
+	// response headers, so the response starts
+	// with the next headers, data or FIN.
+	UpdateHeader(push.header, header)
+	if push.promised {
+		p.start(request, push)
+	}
+	push.promised = true
+}
+
+func (p *PushHandler) ReceiveData(request *http.Request, data []byte, final bool) {
+	push := p.push(request)
+	if push == nil {
+		return
+	}
+	if push.response == nil {
+		p.start(request, push)
+	}
+	if len(data) > 0 {
+		push.body.Write(data)
+	}
+	if final {
+		p.lock.Lock()
+		delete(p.pushes, request)
+		p.lock.Unlock()
+
+		// The trailers are given before the body
+		// ends, so Handle can read them safely
+		// once it has read the body in full.
+		UpdateHeader(push.response.Trailer, push.trailer)
+		push.body.CloseWithError(nil)
+	}
+}
+
+func (p *PushHandler) push(request *http.Request) *pushedResponse {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.pushes[request]
+}
+
+// start builds the response, once the
+// headers have arrived, and passes it to
+// Handle.
+func (p *PushHandler) start(request *http.Request, push *pushedResponse) {
+	status := push.header.Get(":status")
+	if status == "" {
+		status = push.header.Get("status") // SPDY/2
+	}
+	code, _ := strconv.Atoi(strings.SplitN(strings.TrimSpace(status), " ", 2)[0])
+
+	header := make(http.Header)
+	for name, values := range push.header {
+		if !strings.HasPrefix(name, ":") {
+			header[name] = values
+		}
+	}
+
+	push.response = &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          push.body,
+		ContentLength: -1,
+		Trailer:       make(http.Header),
+		Request:       request,
+	}
+
+	if p.Handle == nil {
+		push.body.Close()
+		return
+	}
+	go p.Handle(request, push.response)
+}
+
+// watch ends the push once its request's
+// context is done. If the push has not
+// finished, the body returns the cause,
+// such as a *StreamResetError.
+func (p *PushHandler) watch(request *http.Request, push *pushedResponse) {
+	<-request.Context().Done()
+
+	p.lock.Lock()
+	delete(p.pushes, request)
+	p.lock.Unlock()
+
+	err := context.Cause(request.Context())
+	if err == context.Canceled {
+		err = ErrStreamClosed
+	}
+	push.body.CloseWithError(err)
+}
@@ -0,0 +1,77 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+func TestPushHandlerHeadersOnly(t *testing.T) {
+	type result struct {
+		response *http.Response
+		body     []byte
+		err      error
+	}
+	results := make(chan result, 1)
+	started := make(chan struct{})
+	handler := &common.PushHandler{
+		Handle: func(pushed *http.Request, response *http.Response) {
+			close(started)
+			body, err := ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			results <- result{response, body, err}
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	request, err := http.NewRequest("GET", "http://example.com/empty", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request = request.WithContext(ctx)
+	if !handler.ReceiveRequest(request) {
+		t.Fatal("Expected push to be accepted.")
+	}
+
+	// Handle is called once the response
+	// headers arrive, before any data.
+	handler.ReceiveHeader(request, http.Header{":status": {"204 No Content"}})
+	handler.ReceiveHeader(request, http.Header{"Content-Type": {"text/plain"}})
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for Handle.")
+	}
+
+	// The push ends with FIN on HEADERS, which
+	// the connection gives as final, empty data.
+	handler.ReceiveHeader(request, http.Header{"X-Checksum": {"abc"}})
+	handler.ReceiveData(request, nil, true)
+
+	select {
+	case res := <-results:
+		if res.err != nil || len(res.body) != 0 {
+			t.Errorf("Expected empty body. Got %q, %v", res.body, res.err)
+		}
+		if res.response.StatusCode != http.StatusNoContent {
+			t.Errorf("Expected status 204. Got %d", res.response.StatusCode)
+		}
+		if typ := res.response.Header.Get("Content-Type"); typ != "text/plain" {
+			t.Errorf("Expected Content-Type text/plain. Got %q", typ)
+		}
+		if sum := res.response.Trailer.Get("X-Checksum"); sum != "abc" {
+			t.Errorf("Expected trailer X-Checksum abc. Got %q", sum)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for body.")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"errors"
+	"net/http"
+)
+
+// PushOptions describes a server push in more detail than
+// its URL alone. The zero value describes a GET request
+// with a 200 response, sent at the same priority as its
+// associated stream.
+type PushOptions struct {
+	// Method is the method of the pushed request,
+	// which must be GET or HEAD. If empty, GET is
+	// used.
+	Method string
+
+	// Status is the status code of the pushed
+	// response. If zero, 200 is used.
+	Status int
+
+	// ResponseHeader contains response headers to
+	// send in the SYN_STREAM. Headers set on the
+	// PushStream are sent later, in HEADERS frames.
+	ResponseHeader http.Header
+
+	// Priority is the priority of the push relative
+	// to its associated stream, so 0 is the same
+	// priority and 1 is one level lower. The result
+	// is limited to the version's range of priorities,
+	// so a Priority of 7 or more gives the lowest
+	// priority, as used by Push.
+	Priority int
+}
+
+// Prepare checks the options, returning a copy with the
+// defaults filled in. Prepare accepts nil options.
+func (o *PushOptions) Prepare() (*PushOptions, error) {
+	out := new(PushOptions)
+	if o != nil {
+		*out = *o
+	}
+
+	switch out.Method {
+	case "":
+		out.Method = "GET"
+	case "GET", "HEAD":
+	default:
+		return nil, errors.New("Error: Pushed requests must use GET or HEAD.")
+	}
+
+	if out.Status == 0 {
+		out.Status = http.StatusOK
+	}
+	if out.Status < 100 || out.Status > 999 {
+		return nil, errors.New("Error: Invalid push status code.")
+	}
+
+	return out, nil
+}
+
+// PushPriority returns the priority of a push with the
+// given options, associated with a stream of the given
+// priority, where lowest is the lowest priority in the
+// SPDY version used.
+func (o *PushOptions) PushPriority(origin Priority, lowest Priority) Priority {
+	p := int(origin) + o.Priority
+	if p < 0 {
+		return 0
+	}
+	if p > int(lowest) {
+		return lowest
+	}
+	return Priority(p)
+}
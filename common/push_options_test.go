@@ -0,0 +1,34 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common_test
+
+import (
+	"testing"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+func TestPushPriority(t *testing.T) {
+	tests := []struct {
+		priority int
+		origin   common.Priority
+		expected common.Priority
+	}{
+		{0, 2, 2},
+		{0, 0, 0},
+		{1, 2, 3},
+		{-1, 2, 1},
+		{-5, 2, 0},
+		{7, 0, 7},
+		{9, 2, 7},
+	}
+
+	for _, test := range tests {
+		options := &common.PushOptions{Priority: test.priority}
+		if p := options.PushPriority(test.origin, 7); p != test.expected {
+			t.Errorf("Priority %d from %d: expected %d. Got %d", test.priority, test.origin, test.expected, p)
+		}
+	}
+}
@@ -126,20 +126,35 @@ var _MAX_MEM_STORAGE = 10 * 1024 * 1024
 type hybridBuffer struct {
 	io.Reader
 
-	buf     *bytes.Buffer
-	file    *os.File
-	written int64
+	buf      *bytes.Buffer
+	file     *os.File
+	written  int64
+	memory   *MemoryBudget
+	reserved int // bytes reserved from memory.
 }
 
 func newHybridBuffer() *hybridBuffer {
 	hb := new(hybridBuffer)
 	hb.buf = new(bytes.Buffer)
 	hb.Reader = hb.buf
+	hb.memory = DefaultMemoryBudget
 	return hb
 }
 
+// reserve returns whether the memory budget
+// allows n more bytes to be stored in memory.
+func (h *hybridBuffer) reserve(n int) bool {
+	if !h.memory.Reserve(n) {
+		return false
+	}
+	h.reserved += n
+	return true
+}
+
 func (h *hybridBuffer) Close() error {
 	h.buf.Reset()
+	h.memory.Release(h.reserved)
+	h.reserved = 0
 	if h.file != nil {
 		err := h.file.Close()
 		if err != nil {
@@ -171,15 +186,14 @@ func (h *hybridBuffer) Write(b []byte) (int, error) {
 	var err error
 
 	// Straight to memory
-	if len(b)+buffered < _MAX_MEM_STORAGE {
+	if len(b)+buffered < _MAX_MEM_STORAGE && h.reserve(len(b)) {
 		n, err := h.buf.Write(b)
 		h.written += int64(n)
 		return n, err
 	}
 
 	// Partially to disk
-	if buffered < _MAX_MEM_STORAGE {
-		mem := _MAX_MEM_STORAGE - buffered
+	if mem := _MAX_MEM_STORAGE - buffered; mem > 0 && mem < len(b) && h.reserve(mem) {
 		n, err := h.buf.Write(b[:mem])
 		h.written += int64(n)
 		if err != nil {
@@ -0,0 +1,416 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+// QueuedFrame is a frame waiting to be sent on
+// a stream, with the details used to schedule it.
+type QueuedFrame struct {
+	Frame    Frame
+	StreamID StreamID
+	Priority Priority
+	Size     int // payload size in bytes.
+}
+
+// cost is the share of the connection's
+// bandwidth used by sending the frame,
+// including the 8-byte frame header.
+func (f QueuedFrame) cost() int {
+	return f.Size + 8
+}
+
+// Scheduler decides the order in which a connection
+// sends the frames queued on its streams. Control
+// frames, such as PING, SETTINGS, GOAWAY, RST_STREAM
+// and WINDOW_UPDATE, are always sent first, so are
+// not given to the Scheduler.
+//
+// A stream's frames must be sent in the order they
+// were pushed. Each frame is scheduled at its own
+// priority, so a stream's queue takes the priority
+// of the frame at its head. A Scheduler is used by
+// only one connection, which serialises calls to it.
+type Scheduler interface {
+	// Push queues a frame.
+	Push(QueuedFrame)
+
+	// Pop removes and returns the next frame
+	// to send. The returned bool is false if
+	// no frames are queued.
+	Pop() (QueuedFrame, bool)
+
+	// Discard removes and returns any frames
+	// queued for the given stream, such as
+	// once it has been reset.
+	Discard(StreamID) []QueuedFrame
+
+	// SetPriority moves any frames queued for
+	// the given stream to the given priority,
+	// taking effect from the next Pop.
+	SetPriority(StreamID, Priority)
+
+	// Len returns the number of frames queued.
+	Len() int
+}
+
+// DefaultScheduler is used to create the Scheduler for
+// each connection created without a Config, or whose
+// Config has no Scheduler.
+var DefaultScheduler = func() Scheduler {
+	return NewWFQScheduler()
+}
+
+// DefaultWeights gives each priority's share of the
+// connection under weighted scheduling. Priority 0
+// has eight times the share of priority 7.
+var DefaultWeights = [8]int{8, 7, 6, 5, 4, 3, 2, 1}
+
+// frameQueue holds the frames
+// queued for one stream.
+type frameQueue struct {
+	streamID StreamID
+	priority Priority // priority the queue is filed under.
+	frames   []QueuedFrame
+	finish   []float64 // WFQ finish tags for frames.
+	last     float64   // WFQ finish tag of the last frame pushed.
+	deficit  int       // DRR bytes the stream may send.
+	credited bool      // DRR quantum added this round.
+}
+
+func (q *frameQueue) pop() QueuedFrame {
+	out := q.frames[0]
+	q.frames[0] = QueuedFrame{}
+	q.frames = q.frames[1:]
+	if len(q.finish) > 0 {
+		q.finish = q.finish[1:]
+	}
+	return out
+}
+
+// removeQueue removes the given queue from the list.
+func removeQueue(list []*frameQueue, q *frameQueue) []*frameQueue {
+	for i, other := range list {
+		if other == q {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+func clampPriority(priority Priority) Priority {
+	if priority > 7 {
+		return 7
+	}
+	return priority
+}
+
+/**********************
+ * PriorityScheduler *
+ **********************/
+
+// PriorityScheduler sends frames in strict priority
+// order, so that lower-priority streams only send
+// when no higher-priority stream has frames queued.
+// Streams of the same priority take turns, sending
+// one frame each.
+type PriorityScheduler struct {
+	streams map[StreamID]*frameQueue
+	ready   [8][]*frameQueue // streams with frames, by priority.
+	length  int
+}
+
+func NewPriorityScheduler() *PriorityScheduler {
+	out := new(PriorityScheduler)
+	out.streams = make(map[StreamID]*frameQueue)
+	return out
+}
+
+func (s *PriorityScheduler) Push(frame QueuedFrame) {
+	frame.Priority = clampPriority(frame.Priority)
+	q := s.streams[frame.StreamID]
+	if q == nil {
+		q = &frameQueue{streamID: frame.StreamID, priority: frame.Priority}
+		s.streams[frame.StreamID] = q
+		s.ready[q.priority] = append(s.ready[q.priority], q)
+	}
+	q.frames = append(q.frames, frame)
+	s.length++
+}
+
+func (s *PriorityScheduler) Pop() (QueuedFrame, bool) {
+	for priority := range s.ready {
+		if len(s.ready[priority]) == 0 {
+			continue
+		}
+
+		// Take the next stream in turn, moving
+		// it to the back unless it is done.
+		q := s.ready[priority][0]
+		s.ready[priority] = s.ready[priority][1:]
+		out := q.pop()
+		s.length--
+		if len(q.frames) > 0 {
+			q.priority = q.frames[0].Priority
+			s.ready[q.priority] = append(s.ready[q.priority], q)
+		} else {
+			delete(s.streams, q.streamID)
+		}
+		return out, true
+	}
+
+	return QueuedFrame{}, false
+}
+
+func (s *PriorityScheduler) Discard(streamID StreamID) []QueuedFrame {
+	q := s.streams[streamID]
+	if q == nil {
+		return nil
+	}
+	delete(s.streams, streamID)
+	s.ready[q.priority] = removeQueue(s.ready[q.priority], q)
+	s.length -= len(q.frames)
+	return q.frames
+}
+
+func (s *PriorityScheduler) SetPriority(streamID StreamID, priority Priority) {
+	priority = clampPriority(priority)
+	q := s.streams[streamID]
+	if q == nil {
+		return
+	}
+	for i := range q.frames {
+		q.frames[i].Priority = priority
+	}
+	if q.priority != priority {
+		s.ready[q.priority] = removeQueue(s.ready[q.priority], q)
+		q.priority = priority
+		s.ready[priority] = append(s.ready[priority], q)
+	}
+}
+
+func (s *PriorityScheduler) Len() int {
+	return s.length
+}
+
+/*****************
+ * WFQScheduler *
+ *****************/
+
+// WFQScheduler shares the connection between streams
+// with weighted fair queueing. Each stream receives a
+// share of the bandwidth in proportion to the weight
+// of its priority, so low-priority streams are slowed
+// rather than starved.
+//
+// This uses self-clocked fair queueing, giving each
+// frame a finish tag when it is pushed, and sending
+// the frame with the earliest tag.
+type WFQScheduler struct {
+	Weights [8]int // weight of each priority.
+
+	streams map[StreamID]*frameQueue
+	active  []*frameQueue // streams with frames, in order of arrival.
+	clock   float64       // finish tag of the frame last sent.
+	length  int
+}
+
+// NewWFQScheduler produces a WFQScheduler
+// using DefaultWeights.
+func NewWFQScheduler() *WFQScheduler {
+	out := new(WFQScheduler)
+	out.Weights = DefaultWeights
+	out.streams = make(map[StreamID]*frameQueue)
+	return out
+}
+
+func (s *WFQScheduler) weight(priority Priority) float64 {
+	if w := s.Weights[priority]; w > 0 {
+		return float64(w)
+	}
+	return 1
+}
+
+func (s *WFQScheduler) Push(frame QueuedFrame) {
+	frame.Priority = clampPriority(frame.Priority)
+	q := s.streams[frame.StreamID]
+	if q == nil {
+		q = &frameQueue{streamID: frame.StreamID}
+		s.streams[frame.StreamID] = q
+		s.active = append(s.active, q)
+	}
+
+	start := s.clock
+	if len(q.frames) > 0 && q.last > start {
+		start = q.last
+	}
+	q.last = start + float64(frame.cost())/s.weight(frame.Priority)
+	q.frames = append(q.frames, frame)
+	q.finish = append(q.finish, q.last)
+	s.length++
+}
+
+func (s *WFQScheduler) Pop() (QueuedFrame, bool) {
+	if len(s.active) == 0 {
+		return QueuedFrame{}, false
+	}
+
+	// Find the earliest finish tag.
+	next := s.active[0]
+	for _, q := range s.active[1:] {
+		if q.finish[0] < next.finish[0] {
+			next = q
+		}
+	}
+
+	s.clock = next.finish[0]
+	out := next.pop()
+	s.length--
+	if len(next.frames) == 0 {
+		delete(s.streams, next.streamID)
+		s.active = removeQueue(s.active, next)
+	}
+	return out, true
+}
+
+func (s *WFQScheduler) Discard(streamID StreamID) []QueuedFrame {
+	q := s.streams[streamID]
+	if q == nil {
+		return nil
+	}
+	delete(s.streams, streamID)
+	s.active = removeQueue(s.active, q)
+	s.length -= len(q.frames)
+	return q.frames
+}
+
+// SetPriority also recalculates the finish
+// tags of the stream's frames, as though
+// they had been pushed at the new priority.
+func (s *WFQScheduler) SetPriority(streamID StreamID, priority Priority) {
+	priority = clampPriority(priority)
+	q := s.streams[streamID]
+	if q == nil {
+		return
+	}
+	tag := s.clock
+	for i := range q.frames {
+		q.frames[i].Priority = priority
+		tag += float64(q.frames[i].cost()) / s.weight(priority)
+		q.finish[i] = tag
+	}
+	q.last = tag
+}
+
+func (s *WFQScheduler) Len() int {
+	return s.length
+}
+
+/*****************
+ * DRRScheduler *
+ *****************/
+
+// DRRScheduler shares the connection between streams
+// with deficit round-robin. Streams take turns, each
+// sending up to Quantum bytes, multiplied by the
+// weight of its priority, per round. Unused credit
+// is carried over while the stream has frames queued,
+// so large frames are sent once enough has built up.
+type DRRScheduler struct {
+	Quantum int    // bytes per round at weight 1.
+	Weights [8]int // weight of each priority.
+
+	streams map[StreamID]*frameQueue
+	active  []*frameQueue // streams with frames, in turn order.
+	length  int
+}
+
+// NewDRRScheduler produces a DRRScheduler with the
+// given quantum, using DefaultWeights.
+func NewDRRScheduler(quantum int) *DRRScheduler {
+	if quantum <= 0 {
+		quantum = 1024
+	}
+	out := new(DRRScheduler)
+	out.Quantum = quantum
+	out.Weights = DefaultWeights
+	out.streams = make(map[StreamID]*frameQueue)
+	return out
+}
+
+func (s *DRRScheduler) quantum(priority Priority) int {
+	w := s.Weights[priority]
+	if w <= 0 {
+		w = 1
+	}
+	if s.Quantum <= 0 {
+		return w
+	}
+	return s.Quantum * w
+}
+
+func (s *DRRScheduler) Push(frame QueuedFrame) {
+	frame.Priority = clampPriority(frame.Priority)
+	q := s.streams[frame.StreamID]
+	if q == nil {
+		q = &frameQueue{streamID: frame.StreamID}
+		s.streams[frame.StreamID] = q
+		s.active = append(s.active, q)
+	}
+	q.frames = append(q.frames, frame)
+	s.length++
+}
+
+func (s *DRRScheduler) Pop() (QueuedFrame, bool) {
+	for len(s.active) > 0 {
+		q := s.active[0]
+		if !q.credited {
+			q.deficit += s.quantum(q.frames[0].Priority)
+			q.credited = true
+		}
+
+		// The stream has used its turn.
+		if cost := q.frames[0].cost(); cost > q.deficit {
+			q.credited = false
+			s.active = append(s.active[1:], q)
+			continue
+		}
+
+		out := q.pop()
+		q.deficit -= out.cost()
+		s.length--
+		if len(q.frames) == 0 {
+			delete(s.streams, q.streamID)
+			s.active = s.active[1:]
+		}
+		return out, true
+	}
+
+	return QueuedFrame{}, false
+}
+
+func (s *DRRScheduler) Discard(streamID StreamID) []QueuedFrame {
+	q := s.streams[streamID]
+	if q == nil {
+		return nil
+	}
+	delete(s.streams, streamID)
+	s.active = removeQueue(s.active, q)
+	s.length -= len(q.frames)
+	return q.frames
+}
+
+func (s *DRRScheduler) SetPriority(streamID StreamID, priority Priority) {
+	priority = clampPriority(priority)
+	q := s.streams[streamID]
+	if q == nil {
+		return
+	}
+	for i := range q.frames {
+		q.frames[i].Priority = priority
+	}
+}
+
+func (s *DRRScheduler) Len() int {
+	return s.length
+}
@@ -0,0 +1,141 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+// queueData pushes n DATA frames of the given size
+// for a stream, numbering them in their payloads.
+func queueData(s common.Scheduler, sid common.StreamID, priority common.Priority, n, size int) {
+	for i := 0; i < n; i++ {
+		data := &frames.DATA{StreamID: sid, Data: make([]byte, size)}
+		data.Data[0] = byte(i)
+		s.Push(common.QueuedFrame{Frame: data, StreamID: sid, Priority: priority, Size: size})
+	}
+}
+
+// popShares pops n more frames, checking that each
+// stream's frames are in order, and adds them to the
+// count of frames sent per stream.
+func popShares(t *testing.T, s common.Scheduler, n int, shares map[common.StreamID]int) map[common.StreamID]int {
+	for i := 0; i < n; i++ {
+		queued, ok := s.Pop()
+		if !ok {
+			t.Fatalf("Expected %d frames. Got %d", n, i)
+		}
+		data := queued.Frame.(*frames.DATA)
+		if int(data.Data[0]) != shares[data.StreamID] {
+			t.Fatalf("Expected frame %d of stream %d. Got frame %d", shares[data.StreamID], data.StreamID, data.Data[0])
+		}
+		shares[data.StreamID]++
+	}
+	return shares
+}
+
+func TestSchedulers(t *testing.T) {
+	// Strict priority sends all of the
+	// high-priority stream first.
+	strict := common.NewPriorityScheduler()
+	queueData(strict, 1, 7, 50, 1000)
+	queueData(strict, 3, 0, 50, 1000)
+	if shares := popShares(t, strict, 50, map[common.StreamID]int{}); shares[3] != 50 {
+		t.Errorf("Expected priority 0 first. Got %v", shares)
+	}
+
+	// Weighted schedulers share in proportion
+	// to weights, without starvation.
+	for name, s := range map[string]common.Scheduler{
+		"WFQ": common.NewWFQScheduler(),
+		"DRR": common.NewDRRScheduler(1000),
+	} {
+		queueData(s, 1, 7, 100, 1000)
+		queueData(s, 3, 0, 100, 1000)
+		shares := popShares(t, s, 90, map[common.StreamID]int{})
+		if shares[3] < 75 || shares[3] > 85 || shares[1] == 0 {
+			t.Errorf("%s: Expected an 8:1 share. Got %v", name, shares)
+		}
+		popShares(t, s, 110, shares)
+		if s.Len() != 0 {
+			t.Errorf("%s: Expected an empty queue. Got %d", name, s.Len())
+		}
+	}
+
+	// Each frame is scheduled at its own priority,
+	// so a push is announced before its stream is
+	// deprioritised.
+	for name, s := range map[string]common.Scheduler{
+		"priority": common.NewPriorityScheduler(),
+		"WFQ":      common.NewWFQScheduler(),
+	} {
+		queueData(s, 1, 3, 20, 1000)
+		push := &frames.SYN_STREAM{StreamID: 2, Priority: 7}
+		s.Push(common.QueuedFrame{Frame: push, StreamID: 2, Priority: 0})
+		queueData(s, 2, 7, 1, 1000)
+		if queued, _ := s.Pop(); queued.Frame != push {
+			t.Errorf("%s: Expected the SYN_STREAM first. Got %s", name, queued.Frame.Name())
+		}
+		if n := len(s.Discard(2)); n != 1 || s.Len() != 20 {
+			t.Errorf("%s: Expected 1 frame discarded and 20 left. Got %d and %d", name, n, s.Len())
+		}
+	}
+}
+
+func TestSchedulerSetPriority(t *testing.T) {
+	// Queued frames move to the new priority.
+	for name, s := range map[string]common.Scheduler{
+		"priority": common.NewPriorityScheduler(),
+		"WFQ":      common.NewWFQScheduler(),
+		"DRR":      common.NewDRRScheduler(1000),
+	} {
+		queueData(s, 1, 0, 40, 1000)
+		queueData(s, 3, 7, 40, 1000)
+		s.SetPriority(1, 7)
+		s.SetPriority(3, 0)
+		shares := popShares(t, s, 20, map[common.StreamID]int{})
+		if shares[3] < 16 || (name == "priority" && shares[3] != 20) {
+			t.Errorf("%s: Expected stream 3 to be promoted. Got %v", name, shares)
+		}
+		expected := map[common.StreamID]common.Priority{1: 7, 3: 0}
+		for queued, ok := s.Pop(); ok; queued, ok = s.Pop() {
+			if queued.Priority != expected[queued.StreamID] {
+				t.Fatalf("%s: Expected stream %d at priority %d. Got %d", name, queued.StreamID, expected[queued.StreamID], queued.Priority)
+			}
+		}
+	}
+}
+
+func TestSchedulerReprioritise(t *testing.T) {
+	// Promoting a stream sends its queued
+	// frames ahead of those already waiting.
+	s := common.NewPriorityScheduler()
+	queueData(s, 1, 2, 3, 1000)
+	queueData(s, 3, 5, 3, 1000)
+
+	order := func(n int) []common.StreamID {
+		var out []common.StreamID
+		for i := 0; i < n; i++ {
+			queued, ok := s.Pop()
+			if !ok {
+				t.Fatalf("Expected %d frames. Got %d", n, i)
+			}
+			out = append(out, queued.StreamID)
+		}
+		return out
+	}
+
+	if got := fmt.Sprint(order(1)); got != "[1]" {
+		t.Errorf("Expected stream 1 first. Got %s", got)
+	}
+	s.SetPriority(3, 0)
+	if got := fmt.Sprint(order(5)); got != "[3 3 3 1 1]" {
+		t.Errorf("Expected [3 3 3 1 1] after promoting stream 3. Got %s", got)
+	}
+}
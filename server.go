@@ -21,6 +21,13 @@ import (
 // net.Conn for the underlying connection, and the given http.Server to
 // configure the request serving.
 func NewServerConn(conn net.Conn, server *http.Server, version, subversion int) (common.Conn, error) {
+	return NewServerConnWithConfig(conn, server, nil, version, subversion)
+}
+
+// NewServerConnWithConfig is like NewServerConn, but uses
+// the given Config for the connection. If config is nil,
+// the defaults from common.DefaultConfig are used.
+func NewServerConnWithConfig(conn net.Conn, server *http.Server, config *common.Config, version, subversion int) (common.Conn, error) {
 	if conn == nil {
 		return nil, errors.New("Error: Connection initialised with nil net.conn.")
 	}
@@ -30,10 +37,10 @@ func NewServerConn(conn net.Conn, server *http.Server, version, subversion int)
 
 	switch version {
 	case 3:
-		return spdy3.NewConn(conn, server, subversion), nil
+		return spdy3.NewConn(conn, server, subversion, config), nil
 
 	case 2:
-		return spdy2.NewConn(conn, server), nil
+		return spdy2.NewConn(conn, server, config), nil
 
 	default:
 		return nil, errors.New("Error: Unsupported SPDY version.")
@@ -52,28 +59,42 @@ func NewServerConn(conn net.Conn, server *http.Server, version, subversion int)
 //
 // See examples/server/server.go for a simple example server.
 func ListenAndServeTLS(addr string, certFile string, keyFile string, handler http.Handler) error {
-	npnStrings := npn()
-	server := &http.Server{
-		Addr:    addr,
-		Handler: handler,
-		TLSConfig: &tls.Config{
-			NextProtos: npnStrings,
-		},
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	config, err := loadTLSConfig(certFile, keyFile)
+	if err != nil {
+		return err
 	}
 
-	for _, str := range npnStrings {
-		switch str {
-		case "spdy/2":
-			server.TLSNextProto[str] = spdy2.NextProto
-		case "spdy/3":
-			server.TLSNextProto[str] = spdy3.NextProto
-		case "spdy/3.1":
-			server.TLSNextProto[str] = spdy3.NextProto1
-		}
+	l, err := listen(addr)
+	if err != nil {
+		return err
 	}
 
-	return server.ListenAndServeTLS(certFile, keyFile)
+	return ServeTLS(l, config, handler)
+}
+
+// ServeTLS accepts incoming connections on the Listener l,
+// performing the TLS handshake with config and serving both
+// SPDY and HTTPS, depending on the protocol negotiated with
+// each client. Handler is typically nil, in which case the
+// DefaultServeMux is used.
+//
+// The certificates are taken from config, which must provide
+// either Certificates or GetCertificate. This allows
+// certificates to be loaded in memory, or chosen per
+// connection. Config is not modified.
+func ServeTLS(l net.Listener, config *tls.Config, handler http.Handler) error {
+	config, err := prepareTLSConfig(config)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:   handler,
+		TLSConfig: config,
+	}
+	AddSPDY(server)
+
+	return server.Serve(tls.NewListener(l, server.TLSConfig))
 }
 
 // ListenAndServeSpdyOnly listens on the TCP network address addr
@@ -91,20 +112,49 @@ func ListenAndServeTLS(addr string, certFile string, keyFile string, handler htt
 //
 // See examples/spdy_only_server/server.go for a simple example server.
 func ListenAndServeSpdyOnly(addr string, certFile string, keyFile string, handler http.Handler) error {
+	config, err := loadTLSConfig(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	l, err := listen(addr)
+	if err != nil {
+		return err
+	}
+
+	return ServeSpdyOnly(l, config, handler)
+}
+
+// ServeSpdyOnly accepts incoming connections on the Listener l,
+// performing the TLS handshake with config and serving SPDY.
+// Handler is typically nil, in which case the DefaultServeMux
+// is used.
+//
+// As with ServeTLS, the certificates are taken from config.
+//
+// IMPORTANT NOTE: Unlike spdy.ServeTLS, this function will ONLY
+// serve SPDY. Connections which do not negotiate a version of
+// SPDY are closed once the TLS handshake has completed.
+func ServeSpdyOnly(l net.Listener, config *tls.Config, handler http.Handler) error {
+	config, err := prepareTLSConfig(config)
+	if err != nil {
+		return err
+	}
+
+	// Only advertise SPDY.
 	npnStrings := npn()
-	if addr == "" {
-		addr = ":https"
+	npnStrings = npnStrings[:len(npnStrings)-1]
+	if len(npnStrings) == 0 {
+		return errors.New("Error: No SPDY versions are enabled.")
 	}
+	config.NextProtos = npnStrings
+
 	if handler == nil {
 		handler = http.DefaultServeMux
 	}
 	server := &http.Server{
-		Addr:    addr,
-		Handler: handler,
-		TLSConfig: &tls.Config{
-			NextProtos:   npnStrings,
-			Certificates: make([]tls.Certificate, 1),
-		},
+		Handler:      handler,
+		TLSConfig:    config,
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 	}
 
@@ -119,81 +169,87 @@ func ListenAndServeSpdyOnly(addr string, certFile string, keyFile string, handle
 		}
 	}
 
-	var err error
-	server.TLSConfig.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+	return serve(tls.NewListener(l, server.TLSConfig), func(conn net.Conn) {
+		serveSPDY(conn, server)
+	})
+}
+
+// ListenAndServeSPDYNoNPN creates a server that listens exclusively
+// for SPDY and (unlike the rest of the package) will not support
+// HTTPS.
+func ListenAndServeSPDYNoNPN(addr string, certFile string, keyFile string, handler http.Handler, version, subversion int) error {
+	config, err := loadTLSConfig(certFile, keyFile)
 	if err != nil {
 		return err
 	}
 
-	conn, err := net.Listen("tcp", addr)
+	l, err := listen(addr)
 	if err != nil {
 		return err
 	}
 
-	tlsListener := tls.NewListener(conn, server.TLSConfig)
-	defer tlsListener.Close()
-
-	// Main loop
-	var tempDelay time.Duration
-	for {
-		rw, e := tlsListener.Accept()
-		if e != nil {
-			if ne, ok := e.(net.Error); ok && ne.Temporary() {
-				if tempDelay == 0 {
-					tempDelay = 5 * time.Millisecond
-				} else {
-					tempDelay *= 2
-				}
-				if max := 1 * time.Second; tempDelay > max {
-					tempDelay = max
-				}
-				log.Printf("Accept error: %v; retrying in %v", e, tempDelay)
-				time.Sleep(tempDelay)
-				continue
-			}
-			return e
-		}
-		tempDelay = 0
-		go serveSPDY(rw, server)
-	}
+	return ServeSPDYNoNPN(l, config, handler, version, subversion)
 }
 
-// ListenAndServeSPDYNoNPN creates a server that listens exclusively
-// for SPDY and (unlike the rest of the package) will not support
-// HTTPS.
-func ListenAndServeSPDYNoNPN(addr string, certFile string, keyFile string, handler http.Handler, version, subversion int) error {
-	if addr == "" {
-		addr = ":https"
+// ServeSPDYNoNPN accepts incoming connections on the Listener l,
+// performing the TLS handshake with config and serving the given
+// version of SPDY without negotiation. As with ServeTLS, the
+// certificates are taken from config.
+func ServeSPDYNoNPN(l net.Listener, config *tls.Config, handler http.Handler, version, subversion int) error {
+	config, err := prepareTLSConfig(config)
+	if err != nil {
+		return err
 	}
+
 	if handler == nil {
 		handler = http.DefaultServeMux
 	}
 	server := &http.Server{
-		Addr:    addr,
-		Handler: handler,
-		TLSConfig: &tls.Config{
-			Certificates: make([]tls.Certificate, 1),
-		},
+		Handler:   handler,
+		TLSConfig: config,
 	}
 
-	var err error
-	server.TLSConfig.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return err
+	return serve(tls.NewListener(l, server.TLSConfig), func(conn net.Conn) {
+		serveSPDYNoNPN(conn, server, version, subversion)
+	})
+}
+
+// listen opens a TCP listener on addr, defaulting
+// to the HTTPS port.
+func listen(addr string) (net.Listener, error) {
+	if addr == "" {
+		addr = ":https"
 	}
+	return net.Listen("tcp", addr)
+}
 
-	conn, err := net.Listen("tcp", addr)
+// loadTLSConfig creates a TLS configuration using
+// the certificate and key in the given files.
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// prepareTLSConfig returns a copy of config, ensuring
+// that it provides the server's certificates.
+func prepareTLSConfig(config *tls.Config) (*tls.Config, error) {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil) {
+		return nil, errors.New("Error: No TLS certificates provided.")
+	}
+	return config.Clone(), nil
+}
 
-	tlsListener := tls.NewListener(conn, server.TLSConfig)
-	defer tlsListener.Close()
+// serve is the main accept loop, calling fn in a
+// new goroutine for each connection accepted from l.
+func serve(l net.Listener, fn func(net.Conn)) error {
+	defer l.Close()
 
-	// Main loop
 	var tempDelay time.Duration
 	for {
-		rw, e := tlsListener.Accept()
+		rw, e := l.Accept()
 		if e != nil {
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
@@ -211,7 +267,7 @@ func ListenAndServeSPDYNoNPN(addr string, certFile string, keyFile string, handl
 			return e
 		}
 		tempDelay = 0
-		go serveSPDYNoNPN(rw, server, version, subversion)
+		go fn(rw)
 	}
 }
 
@@ -237,6 +293,7 @@ func serveSPDY(conn net.Conn, srv *http.Server) {
 		conn.SetWriteDeadline(time.Now().Add(d))
 	}
 	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
 		return
 	}
 
@@ -245,8 +302,12 @@ func serveSPDY(conn net.Conn, srv *http.Server) {
 	proto := tlsState.NegotiatedProtocol
 	if fn := srv.TLSNextProto[proto]; fn != nil {
 		fn(srv, tlsConn, nil)
+		return
 	}
-	return
+
+	// Refuse anything other than SPDY.
+	debug.Printf("Refusing connection from %v with protocol %q.\n", conn.RemoteAddr(), proto)
+	tlsConn.Close()
 }
 
 func serveSPDYNoNPN(conn net.Conn, srv *http.Server, version, subversion int) {
@@ -271,6 +332,7 @@ func serveSPDYNoNPN(conn net.Conn, srv *http.Server, version, subversion int) {
 		conn.SetWriteDeadline(time.Now().Add(d))
 	}
 	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
 		return
 	}
 
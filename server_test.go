@@ -0,0 +1,1980 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/SlyMarbo/spdy"
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+func TestServeSpdyOnly(t *testing.T) {
+	cert, err := tls.X509KeyPair(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatalf("could not read certificate: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer l.Close()
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	go spdy.ServeSpdyOnly(l, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !spdy.UsingSPDY(w) {
+			t.Error("Expected a SPDY connection.")
+		}
+		w.Write([]byte("HELLO"))
+	}))
+
+	url := "https://" + l.Addr().String() + "/"
+
+	// SPDY requests are served.
+	res, err := newClient().Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "HELLO" {
+		t.Errorf("Expected HELLO. Got %q", body)
+	}
+
+	// HTTPS requests are refused.
+	https := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"http/1.1"},
+		},
+	}}
+	if res, err = https.Get(url); err == nil {
+		res.Body.Close()
+		t.Error("Expected HTTPS request to be refused.")
+	}
+
+	if len(config.NextProtos) != 0 {
+		t.Errorf("Expected config to be left unmodified. Got NextProtos %v", config.NextProtos)
+	}
+}
+
+func TestServeTLSNoCertificates(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer l.Close()
+
+	if err = spdy.ServeTLS(l, new(tls.Config), nil); err == nil {
+		t.Error("Expected error serving without certificates.")
+	}
+}
+
+// serveCleartext serves handler with cleartext SPDY and
+// HTTP/1.1 on a local port, and returns a running client
+// connection to it at the given SPDY version, along with
+// the server's URL. Both are closed once the test ends.
+func serveCleartext(t *testing.T, handler http.Handler, receiver common.Receiver, major, minor int) (spdy.Conn, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go spdy.ServeCleartextAndHTTP(l, handler, major, minor)
+
+	tcpConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := spdy.NewClientConn(tcpConn, receiver, major, minor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go conn.Run()
+	t.Cleanup(func() { conn.Close() })
+
+	return conn, "http://" + l.Addr().String()
+}
+
+// serveConfig serves handler with cleartext SPDY on a local
+// port, using config for each connection, and returns a
+// running client connection to it at the given SPDY version,
+// along with the server's URL. Both are closed once the test
+// ends.
+func serveConfig(t *testing.T, handler http.Handler, config *common.Config, receiver common.Receiver, major, minor int) (spdy.Conn, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn, err := spdy.NewServerConnWithConfig(c, &http.Server{Handler: handler}, config, major, minor)
+			if err != nil {
+				c.Close()
+				continue
+			}
+			go conn.Run()
+		}
+	}()
+
+	tcpConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := spdy.NewClientConn(tcpConn, receiver, major, minor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go conn.Run()
+	t.Cleanup(func() { conn.Close() })
+
+	return conn, "http://" + l.Addr().String()
+}
+
+func TestServeCleartextAndHTTP(t *testing.T) {
+	// SPDY with prior knowledge.
+	conn, url := serveCleartext(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if spdy.UsingSPDY(w) {
+			w.Write([]byte("SPDY"))
+		} else {
+			w.Write([]byte("HTTP"))
+		}
+	}), nil, 3, 1)
+	url += "/"
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "SPDY" {
+		t.Errorf("Expected SPDY. Got %q", body)
+	}
+
+	// HTTP/1.1 on the same port.
+	client := &http.Client{Transport: new(http.Transport)}
+	res, err = client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "HTTP" {
+		t.Errorf("Expected HTTP. Got %q", body)
+	}
+}
+
+func TestResponseStreamFlush(t *testing.T) {
+	flushed := make(chan struct{})
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			t.Error("Expected ResponseWriter to be an http.Flusher.")
+			return
+		}
+		w.Header().Set("X-Test", "flushed")
+		flusher.Flush()
+
+		// Wait for the client to receive the headers.
+		select {
+		case <-flushed:
+		case <-time.After(time.Second):
+			t.Error("Timeout waiting for flushed headers.")
+		}
+		w.Write([]byte("HELLO"))
+	}))
+	defer ts.Close()
+
+	client := newClient()
+	client.Transport.(*spdy.Transport).Receiver = &headerReceiver{flushed}
+	res, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get("X-Test") != "flushed" {
+		t.Errorf("Expected X-Test header. Got %v", res.Header)
+	}
+}
+
+// headerReceiver closes its channel once the
+// response headers have been received.
+type headerReceiver struct {
+	received chan struct{}
+}
+
+func (h *headerReceiver) ReceiveData(request *http.Request, data []byte, final bool) {}
+
+func (h *headerReceiver) ReceiveHeader(request *http.Request, header http.Header) {
+	if header.Get("X-Test") != "" {
+		close(h.received)
+	}
+}
+
+func (h *headerReceiver) ReceiveRequest(request *http.Request) bool {
+	return false
+}
+
+// closingReceiver closes its stream from
+// the Receiver when data first arrives.
+type closingReceiver struct {
+	stream chan common.Stream
+	once   sync.Once
+}
+
+func (c *closingReceiver) ReceiveData(request *http.Request, data []byte, final bool) {
+	c.once.Do(func() {
+		(<-c.stream).Close()
+	})
+}
+
+func (c *closingReceiver) ReceiveHeader(request *http.Request, header http.Header) {}
+
+func (c *closingReceiver) ReceiveRequest(request *http.Request) bool {
+	return false
+}
+
+func TestCloseFromReceiver(t *testing.T) {
+	for _, version := range [][2]int{{2, 0}, {3, 1}} {
+		conn, url := serveCleartext(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for i := 0; i < 64; i++ {
+				w.Write(bytes.Repeat([]byte("x"), 1024))
+				w.(http.Flusher).Flush()
+			}
+		}), nil, version[0], version[1])
+
+		req, err := http.NewRequest("GET", url+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiver := &closingReceiver{stream: make(chan common.Stream, 1)}
+		stream, err := conn.Request(req, receiver, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiver.stream <- stream
+
+		done := make(chan struct{})
+		go func() {
+			stream.Run()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("SPDY/%d: Timeout waiting for the stream to finish.", version[0])
+		}
+	}
+}
+
+func TestHijack(t *testing.T) {
+	done := make(chan struct{})
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stream, err := spdy.Hijack(w)
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+
+		// The stream outlives the handler, and the
+		// request's context ends once it is closed.
+		go func() {
+			defer close(done)
+			data, err := ioutil.ReadAll(stream)
+			if err != nil {
+				t.Error(err)
+			}
+			if err := r.Context().Err(); err != nil {
+				t.Errorf("Expected request context to outlive the handler. Got %v", err)
+			}
+			stream.Write([]byte("pong:"))
+			stream.Write(data)
+			stream.Close()
+			if r.Context().Err() == nil {
+				t.Error("Expected request context to end once the stream is closed.")
+			}
+		}()
+	}))
+	defer ts.Close()
+
+	client := newClient()
+	res, err := client.Post(ts.URL, "text/plain", strings.NewReader("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "pong:ping" {
+		t.Errorf("Expected pong:ping. Got %q", body)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Timeout waiting for the hijacked stream to close.")
+	}
+}
+
+func TestStreamingRequestBody(t *testing.T) {
+	// Larger than the initial transfer window, so
+	// the upload relies on the handler reading the
+	// body to regrow the window.
+	upload := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 4096)
+		received := 0
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 && !bytes.Equal(buf[:n], upload[received:received+n]) {
+				t.Errorf("Request body differs at offset %d.", received)
+				return
+			}
+			received += n
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		fmt.Fprint(w, received)
+	}))
+	defer ts.Close()
+
+	client := newClient()
+	res, err := client.Post(ts.URL, "application/octet-stream", bytes.NewReader(upload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprint(len(upload)); string(body) != expected {
+		t.Errorf("Expected %s bytes received. Got %q", expected, body)
+	}
+}
+
+func TestStreamingRequestUpload(t *testing.T) {
+	// The client sends the body as it is read, so
+	// the handler receives each part before the
+	// next is written.
+	received := make(chan string)
+	conn, url := serveCleartext(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 64)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				received <- string(buf[:n])
+			}
+			if err == io.EOF {
+				fmt.Fprint(w, "done")
+			}
+			if err != nil {
+				return
+			}
+		}
+	}), nil, 3, 1)
+
+	body, writer := io.Pipe()
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for _, part := range []string{"first", "second"} {
+			writer.Write([]byte(part))
+			select {
+			case got := <-received:
+				if got != part {
+					t.Errorf("Expected %q. Got %q", part, got)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("Timeout waiting for %q to be received.", part)
+				writer.CloseWithError(common.ErrTimeout)
+				return
+			}
+		}
+		writer.Close()
+	}()
+
+	req, err := http.NewRequest("POST", url+"/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := conn.RequestResponse(req, nil, 0)
+	<-written
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "done" {
+		t.Errorf("Expected done. Got %q", data)
+	}
+
+	// A body which fails resets the stream, and
+	// the connection serves other streams.
+	go func() {
+		for range received {
+		}
+	}()
+	req, err = http.NewRequest("POST", url+"/", io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(io.ErrUnexpectedEOF)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Request(req, common.NewResponse(req, nil), 0); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected %v. Got %v", io.ErrUnexpectedEOF, err)
+	}
+
+	req, err = http.NewRequest("POST", url+"/", strings.NewReader("again"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "done" {
+		t.Errorf("Expected done. Got %q", data)
+	}
+}
+
+func TestSessionFlowControl(t *testing.T) {
+	// Bodies larger than the SPDY/3.1 session window,
+	// in both directions, on consecutive streams and
+	// then on several streams at once.
+	const size = 200 << 10
+	conn, base := serveCleartext(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(ioutil.Discard, r.Body)
+		if err != nil || n != size {
+			t.Errorf("Expected %d bytes received. Got %d (%v)", size, n, err)
+		}
+		w.Write(make([]byte, size))
+	}), nil, 3, 1)
+
+	post := func() error {
+		req, err := http.NewRequest("POST", base+"/", bytes.NewReader(make([]byte, size)))
+		if err != nil {
+			return err
+		}
+		res, err := conn.RequestResponse(req, nil, 0)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		if err == nil && n != size {
+			err = fmt.Errorf("Expected %d bytes. Got %d", size, n)
+		}
+		return err
+	}
+
+	for _, streams := range []int{1, 1, 4} {
+		errs := make(chan error, streams)
+		for i := 0; i < streams; i++ {
+			go func() { errs <- post() }()
+		}
+		for i := 0; i < streams; i++ {
+			select {
+			case err := <-errs:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("Timed out with %d streams.", streams)
+			}
+		}
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	panics := make(chan string, 2)
+	spdy.SetHandlerPanicHook(func(r *http.Request, v interface{}, stack []byte) {
+		if len(stack) == 0 {
+			t.Error("Expected a stack trace.")
+		}
+		panics <- fmt.Sprintf("%s %v", r.URL.Path, v)
+	})
+	defer spdy.SetHandlerPanicHook(nil)
+
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/panic":
+			panic("boom")
+		case "/abort":
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte("HELLO"))
+	}))
+	defer ts.Close()
+
+	client := newClient()
+	res, err := client.Get(ts.URL + "/panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected status 500. Got %d", res.StatusCode)
+	}
+	select {
+	case p := <-panics:
+		if p != "/panic boom" {
+			t.Errorf("Expected panic hook for /panic. Got %q", p)
+		}
+	case <-time.After(time.Second):
+		t.Error("Timeout waiting for panic hook.")
+	}
+
+	res, err = client.Get(ts.URL + "/abort")
+	if err == nil {
+		res.Body.Close()
+	}
+
+	// The connection should still serve other streams.
+	res, err = client.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "HELLO" {
+		t.Errorf("Expected HELLO. Got %q", body)
+	}
+
+	select {
+	case p := <-panics:
+		t.Errorf("Unexpected panic hook call: %q", p)
+	default:
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("HELLO"))
+	}))
+	ts.Config.MaxHeaderBytes = 1024
+	spdy.AddSPDY(ts.Config)
+	ts.TLS = ts.Config.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	client := newClient()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Large", strings.Repeat("a", 4096))
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected status 431. Got %d", res.StatusCode)
+	}
+
+	// Requests which have not finished sending are
+	// reset once the 431 has been sent.
+	req, err = http.NewRequest("POST", ts.URL, strings.NewReader("HELLO"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Large", strings.Repeat("a", 4096))
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected status 431. Got %d", res.StatusCode)
+	}
+
+	// The connection should still serve other streams.
+	res, err = client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "HELLO" {
+		t.Errorf("Expected HELLO. Got %q", body)
+	}
+}
+
+func TestAbusePolicy(t *testing.T) {
+	policy := common.NewAbusePolicy(common.AbuseLimits{
+		Pings: common.RateLimit{Rate: 1, Burst: 3},
+	}, common.AbuseLimits{})
+	config := common.DefaultConfig()
+	config.AbusePolicy = policy
+
+	conn, _ := serveConfig(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("SPDY"))
+	}), config, nil, 3, 1)
+
+	// The first PINGs are within the burst.
+	for i := 0; i < 3; i++ {
+		ping, err := conn.(spdy.Pinger).Ping()
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case ok := <-ping:
+			if !ok {
+				t.Fatalf("PING %d failed.", i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for PING %d.", i)
+		}
+	}
+
+	// The flood should end the connection.
+	for i := 0; i < 10; i++ {
+		ping, err := conn.(spdy.Pinger).Ping()
+		if err != nil {
+			break
+		}
+		select {
+		case <-ping:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for PING.")
+		}
+	}
+
+	stats := policy.Stats()
+	if stats.Violations.Pings == 0 {
+		t.Error("Expected PING violations to be counted.")
+	}
+	if stats.Connections != 1 {
+		t.Errorf("Expected 1 connection to be ended. Got %d", stats.Connections)
+	}
+}
+
+func TestPushPreloads(t *testing.T) {
+	config := common.DefaultConfig()
+	config.PushPreloads = true
+
+	// Only one push is allowed per request, so
+	// font.woff is pushed with the second response.
+	config.PushBudget = common.PushBudget{RequestStreams: 1}
+
+	pushes := &pushReceiver{pushed: make(chan string, 10)}
+	conn, base := serveConfig(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Add("Link", "</style.css>; rel=preload; as=style, </script.js>; rel=preload; nopush")
+			w.Header().Add("Link", "<https://example.com/other.css>; rel=preload")
+			w.Header().Add("Link", "</font.woff>; rel=preload; as=font")
+			w.Write([]byte("INDEX"))
+		default:
+			w.Write([]byte(r.Method + " " + r.URL.Path))
+		}
+	}), config, pushes, 3, 1)
+
+	url := base + "/"
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := conn.RequestResponse(req, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "INDEX" {
+			t.Errorf("Expected INDEX. Got %q", body)
+		}
+	}
+
+	// Each resource should be pushed once, with a
+	// push that failed being retried.
+	for _, expected := range []string{"GET /style.css", "GET /font.woff"} {
+		select {
+		case body := <-pushes.pushed:
+			if body != expected {
+				t.Errorf("Expected push of %q. Got %q", expected, body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for push.")
+		}
+	}
+	select {
+	case body := <-pushes.pushed:
+		t.Errorf("Unexpected push: %q", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// pushReceiver sends the body of each
+// push on its channel once completed.
+type pushReceiver struct {
+	sync.Mutex
+	pushed chan string
+	bodies map[*http.Request][]byte
+}
+
+func (p *pushReceiver) ReceiveData(request *http.Request, data []byte, final bool) {
+	p.Lock()
+	defer p.Unlock()
+	if p.bodies == nil {
+		p.bodies = make(map[*http.Request][]byte)
+	}
+	p.bodies[request] = append(p.bodies[request], data...)
+	if final {
+		p.pushed <- string(p.bodies[request])
+		delete(p.bodies, request)
+	}
+}
+
+func (p *pushReceiver) ReceiveHeader(request *http.Request, header http.Header) {}
+
+func (p *pushReceiver) ReceiveRequest(request *http.Request) bool {
+	return true
+}
+
+func TestAccessLog(t *testing.T) {
+	logs := make(chan *common.StreamLog, 10)
+	config := common.DefaultConfig()
+	config.AccessLogger = common.AccessLoggerFunc(func(l *common.StreamLog) {
+		logs <- l
+	})
+
+	conn, url := serveConfig(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/abort" {
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte("HELLO"))
+	}), config, nil, 3, 1)
+
+	for _, path := range []string{"/", "/abort"} {
+		req, err := http.NewRequest("GET", url+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := conn.RequestResponse(req, nil, 2)
+		if err == nil {
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+		}
+	}
+
+	next := func() *common.StreamLog {
+		select {
+		case l := <-logs:
+			return l
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for access log.")
+		}
+		return nil
+	}
+
+	ok := next()
+	if ok.StreamID != 1 || ok.Version != 3.1 || ok.Priority != 2 || ok.Request.URL.Path != "/" {
+		t.Errorf("Unexpected stream details: %v", ok)
+	}
+	if ok.Status != 200 || ok.BytesOut != 5 || ok.End != common.StreamFinished || ok.Pushed {
+		t.Errorf("Unexpected response details: %v", ok)
+	}
+
+	aborted := next()
+	if aborted.StreamID != 3 || aborted.ConnID != ok.ConnID {
+		t.Errorf("Unexpected stream details: %v", aborted)
+	}
+	if aborted.End != common.StreamReset || aborted.Reset != common.RST_STREAM_INTERNAL_ERROR {
+		t.Errorf("Expected stream to be reset with INTERNAL_ERROR. Got %v", aborted)
+	}
+}
+
+func TestConnectTunnel(t *testing.T) {
+	// The target reads until the client half-closes
+	// the tunnel, then echoes everything back.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, err := ioutil.ReadAll(conn)
+				if err == nil {
+					conn.Write(data)
+				}
+			}()
+		}
+	}()
+
+	for _, version := range [][2]int{{2, 0}, {3, 0}, {3, 1}} {
+		conn, _ := serveCleartext(t, new(spdy.ConnectProxy), nil, version[0], version[1])
+		tunnel, err := spdy.DialTunnel(conn, target.Addr().String())
+		if err != nil {
+			t.Fatalf("SPDY/%d.%d: %v", version[0], version[1], err)
+		}
+
+		// Send more than the initial transfer window.
+		data := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+		if _, err := tunnel.Write(data); err != nil {
+			t.Fatalf("SPDY/%d.%d: %v", version[0], version[1], err)
+		}
+		if err := tunnel.(interface {
+			CloseWrite() error
+		}).CloseWrite(); err != nil {
+			t.Fatalf("SPDY/%d.%d: %v", version[0], version[1], err)
+		}
+
+		tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+		echo, err := ioutil.ReadAll(tunnel)
+		if err != nil {
+			t.Errorf("SPDY/%d.%d: %v", version[0], version[1], err)
+		} else if !bytes.Equal(echo, data) {
+			t.Errorf("SPDY/%d.%d: Expected %d bytes echoed. Got %d", version[0], version[1], len(data), len(echo))
+		}
+
+		tunnel.Close()
+		conn.Close()
+	}
+}
+
+func TestConnectTunnelRefused(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	proxy := &spdy.ConnectProxy{
+		Allow: func(r *http.Request, addr string) bool {
+			return addr != "forbidden.example.com:22"
+		},
+		Dial: func(network, addr string) (net.Conn, error) {
+			<-release
+			return nil, fmt.Errorf("%s is unreachable", addr)
+		},
+	}
+
+	for _, version := range [][2]int{{2, 0}, {3, 0}, {3, 1}} {
+		conn, _ := serveCleartext(t, proxy, nil, version[0], version[1])
+
+		// Addresses which are not allowed are refused.
+		if _, err := spdy.DialTunnel(conn, "forbidden.example.com:22"); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Errorf("SPDY/%d.%d: Expected 403 error. Got %v", version[0], version[1], err)
+		}
+
+		// Waiting for the proxy is limited by the context.
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		_, err := spdy.DialTunnelContext(ctx, conn, "slow.example.com:22")
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("SPDY/%d.%d: Expected %v. Got %v", version[0], version[1], context.DeadlineExceeded, err)
+		}
+
+		conn.Close()
+	}
+}
+
+func TestRequestContextCancelledOnReset(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/slow" {
+			w.Write([]byte("HELLO"))
+			return
+		}
+		close(started)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+			t.Error("Timeout waiting for request context to be cancelled.")
+			return
+		}
+		select {
+		case <-w.(http.CloseNotifier).CloseNotify():
+		case <-time.After(time.Second):
+			t.Error("Timeout waiting for CloseNotify.")
+		}
+		close(cancelled)
+	})
+
+	conn, url := serveCleartext(t, handler, nil, 3, 1)
+
+	req, err := http.NewRequest("GET", url+"/slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := conn.Request(req, common.NewResponse(req, nil), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-started
+	stream.Close() // Sends RST_STREAM.
+
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for handler to be cancelled.")
+	}
+
+	// The connection should still serve other streams.
+	req, err = http.NewRequest("GET", url+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "HELLO" {
+		t.Errorf("Expected HELLO. Got %q", body)
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	cert, err := tls.X509KeyPair(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatalf("could not read certificate: %v", err)
+	}
+	other, err := selfSignedCert("other.test")
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+
+	hosts := new(spdy.VirtualHosts)
+	if err := hosts.Handle("example.com", cert, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("example.com"))
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if err := hosts.Handle("other.test", other, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other.test"))
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if err := hosts.Handle("wrong.test", cert, nil); err == nil {
+		t.Error("Expected error for certificate not valid for host.")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer l.Close()
+	go hosts.ServeTLS(l)
+
+	for _, host := range []string{"example.com", "other.test"} {
+		tlsConn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			ServerName:         host,
+			NextProtos:         []string{"spdy/3.1"},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := spdy.NewClientConn(tlsConn, nil, 3, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go conn.Run()
+
+		// Only the host named with SNI may be
+		// requested on the connection.
+		for _, target := range []string{"example.com", "other.test"} {
+			req, err := http.NewRequest("GET", "https://"+target+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := conn.RequestResponse(req, nil, 0)
+			if target != host {
+				// Refused streams receive no response.
+				if err == nil {
+					res.Body.Close()
+					if res.StatusCode != 0 {
+						t.Errorf("%s: Expected stream for %s to be refused. Got %d", host, target, res.StatusCode)
+					}
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", host, err)
+			}
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != host {
+				t.Errorf("Expected %q. Got %q", host, body)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestVirtualHostsUnknownCertificate(t *testing.T) {
+	cert, err := tls.X509KeyPair(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatalf("could not read certificate: %v", err)
+	}
+	hosts := new(spdy.VirtualHosts)
+	if err := hosts.Handle("example.com", cert, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("example.com"))
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server's TLSConfig does not give the
+	// certificate, so streams cannot be checked
+	// against it and are refused.
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"spdy/3.1"},
+	})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if err := c.(*tls.Conn).Handshake(); err != nil {
+			c.Close()
+			return
+		}
+		conn, err := spdy.NewServerConn(c, &http.Server{Handler: hosts}, 3, 1)
+		if err != nil {
+			c.Close()
+			return
+		}
+		conn.Run()
+	}()
+
+	tlsConn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName:         "example.com",
+		NextProtos:         []string{"spdy/3.1"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := spdy.NewClientConn(tlsConn, nil, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Run()
+
+	req, err := http.NewRequest("GET", "https://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := conn.RequestResponse(req, nil, 0)
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode != 0 {
+			t.Errorf("Expected stream to be refused. Got %d", res.StatusCode)
+		}
+	}
+}
+
+// selfSignedCert creates a certificate for host.
+func selfSignedCert(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func TestPushWithOptions(t *testing.T) {
+	pushes := &optionsReceiver{headers: make(chan http.Header, 1)}
+	conn, base := serveCleartext(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		push, err := spdy.PushWithOptions(w, "http://"+r.Host+"/script.js", &common.PushOptions{
+			Status:         http.StatusNonAuthoritativeInfo,
+			ResponseHeader: http.Header{"Content-Type": {"application/javascript"}},
+			Priority:       1,
+		})
+		if err != nil {
+			t.Error(err)
+		} else {
+			push.Write([]byte("script"))
+			push.Finish()
+		}
+		if _, err := spdy.PushWithOptions(w, "http://"+r.Host+"/form", &common.PushOptions{Method: "POST"}); err == nil {
+			t.Error("Expected error for pushed POST request.")
+		}
+		w.Write([]byte("INDEX"))
+	}), pushes, 3, 1)
+
+	req, err := http.NewRequest("GET", base+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	select {
+	case header := <-pushes.headers:
+		if method := header.Get(":method"); method != "GET" {
+			t.Errorf("Expected method GET. Got %q", method)
+		}
+		if status := header.Get(":status"); status != "203 Non-Authoritative Information" {
+			t.Errorf("Expected status 203. Got %q", status)
+		}
+		if typ := header.Get("Content-Type"); typ != "application/javascript" {
+			t.Errorf("Expected Content-Type application/javascript. Got %q", typ)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for push.")
+	}
+}
+
+// optionsReceiver sends the headers of
+// each push's SYN_STREAM on its channel.
+type optionsReceiver struct {
+	headers chan http.Header
+}
+
+func (o *optionsReceiver) ReceiveData(request *http.Request, data []byte, final bool) {}
+
+func (o *optionsReceiver) ReceiveHeader(request *http.Request, header http.Header) {
+	select {
+	case o.headers <- header:
+	default:
+	}
+}
+
+func (o *optionsReceiver) ReceiveRequest(request *http.Request) bool {
+	return true
+}
+
+func TestPushRefused(t *testing.T) {
+	errs := make(chan error, 1)
+	conn, base := serveCleartext(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		push, err := spdy.Push(w, "http://"+r.Host+"/refused.js")
+		if err != nil {
+			errs <- err
+			return
+		}
+		select {
+		case <-push.Context().Done():
+		case <-time.After(5 * time.Second):
+			errs <- fmt.Errorf("Timed out waiting for push to be refused.")
+			return
+		}
+		_, err = push.Write([]byte("refused"))
+		if reset, ok := err.(*common.StreamResetError); !ok || reset.Status != common.RST_STREAM_REFUSED_STREAM {
+			errs <- fmt.Errorf("Expected REFUSED_STREAM error. Got %v", err)
+			return
+		}
+		if push.Err() != err {
+			errs <- fmt.Errorf("Expected Err to return %v. Got %v", err, push.Err())
+			return
+		}
+		errs <- nil
+	}), refuser{}, 3, 1)
+
+	req, err := http.NewRequest("GET", base+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+}
+
+// refuser refuses all pushes.
+type refuser struct{}
+
+func (refuser) ReceiveData(request *http.Request, data []byte, final bool) {}
+func (refuser) ReceiveHeader(request *http.Request, header http.Header)    {}
+func (refuser) ReceiveRequest(request *http.Request) bool                  { return false }
+
+func TestPushHandler(t *testing.T) {
+	type pushed struct {
+		associated string
+		status     int
+		typ        string
+		body       string
+	}
+	pushes := make(chan pushed, 2)
+	handler := &common.PushHandler{
+		Accept: func(r *http.Request) bool {
+			return r.URL.Path != "/refused.js"
+		},
+		Handle: func(r *http.Request, res *http.Response) {
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			associated := ""
+			if assoc := common.AssociatedRequest(r); assoc != nil {
+				associated = assoc.URL.Path
+			}
+			pushes <- pushed{associated, res.StatusCode, res.Header.Get("Content-Type"), string(body)}
+		},
+	}
+
+	conn, base := serveCleartext(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range []string{"/refused.js", "/script.js"} {
+			push, err := spdy.Push(w, "http://"+r.Host+path)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			push.Header().Set("Content-Type", "application/javascript")
+			push.Write([]byte("pushed " + path))
+			push.Finish()
+		}
+		w.Write([]byte("INDEX"))
+	}), handler, 3, 1)
+
+	req, err := http.NewRequest("GET", base+"/index", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	expected := pushed{"/index", http.StatusOK, "application/javascript", "pushed /script.js"}
+	select {
+	case p := <-pushes:
+		if p != expected {
+			t.Errorf("Expected push %+v. Got %+v", expected, p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for push.")
+	}
+	select {
+	case p := <-pushes:
+		t.Errorf("Unexpected push: %+v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRequestPushReceiver(t *testing.T) {
+	refused := make(chan error, 1)
+	conn, base := serveCleartext(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		push, err := spdy.Push(w, "http://"+r.Host+r.URL.Path+".js")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if r.URL.Path == "/unwanted" {
+			select {
+			case <-push.Context().Done():
+				refused <- push.Err()
+			case <-time.After(5 * time.Second):
+				refused <- fmt.Errorf("Timed out waiting for push to be refused.")
+			}
+			return
+		}
+		push.Write([]byte("pushed " + r.URL.Path))
+		push.Finish()
+	}), nil, 3, 1)
+
+	// Only the request with a push receiver
+	// receives its push.
+	pushes := &pushReceiver{pushed: make(chan string, 1)}
+	for _, path := range []string{"/wanted", "/unwanted"} {
+		req, err := http.NewRequest("GET", base+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path == "/wanted" {
+			req = req.WithContext(common.WithPushReceiver(req.Context(), pushes))
+		}
+		res, err := conn.RequestResponse(req, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	select {
+	case body := <-pushes.pushed:
+		if body != "pushed /wanted" {
+			t.Errorf("Expected push for /wanted. Got %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for push.")
+	}
+
+	err := <-refused
+	if reset, ok := err.(*common.StreamResetError); !ok || reset.Status != common.RST_STREAM_REFUSED_STREAM {
+		t.Errorf("Expected push to be refused. Got %v", err)
+	}
+}
+
+func TestPushBudget(t *testing.T) {
+	config := common.DefaultConfig()
+	config.PushBudget = common.PushBudget{RequestStreams: 2, MaxRefused: 1}
+
+	errs := make(chan error, 4)
+	conn, base := serveConfig(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/second" {
+			_, err := spdy.Push(w, "http://"+r.Host+"/d.js")
+			errs <- err
+			return
+		}
+
+		var first common.PushStream
+		for _, path := range []string{"/a.js", "/b.js", "/c.js"} {
+			push, err := spdy.Push(w, "http://"+r.Host+path)
+			if first == nil {
+				first = push
+			}
+			errs <- err
+		}
+
+		// Wait for the client to refuse the push.
+		select {
+		case <-first.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}), config, refuser{}, 3, 1)
+
+	for _, path := range []string{"/first", "/second"} {
+		req, err := http.NewRequest("GET", base+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := conn.RequestResponse(req, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	for i, name := range []string{"/a.js", "/b.js", "/c.js", "/d.js"} {
+		err := <-errs
+		_, exceeded := err.(*common.PushBudgetError)
+		if i < 2 && err != nil {
+			t.Errorf("%s: Expected push to succeed. Got %v", name, err)
+		} else if i >= 2 && !exceeded {
+			t.Errorf("%s: Expected push budget error. Got %v", name, err)
+		}
+	}
+}
+
+func TestPushByteBudget(t *testing.T) {
+	config := common.DefaultConfig()
+	config.PushBudget = common.PushBudget{RequestBytes: 10}
+
+	for _, version := range [][2]int{{2, 0}, {3, 1}} {
+		type write struct {
+			n   int
+			err error
+		}
+		writes := make(chan write, 2)
+		conn, base := serveConfig(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			push, err := spdy.Push(w, "http://"+r.Host+"/script.js")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for i := 0; i < 2; i++ {
+				n, err := push.Write([]byte("012345"))
+				writes <- write{n, err}
+			}
+			push.Finish()
+		}), config, &optionsReceiver{headers: make(chan http.Header, 1)}, version[0], version[1])
+
+		req, err := http.NewRequest("GET", base+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := conn.RequestResponse(req, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		// The second write is cut short at the limit.
+		for i, expected := range []int{6, 4} {
+			w := <-writes
+			_, exceeded := w.err.(*common.PushBudgetError)
+			if w.n != expected || exceeded != (i == 1) {
+				t.Errorf("SPDY/%d.%d: Write %d: Expected %d bytes. Got %d, %v", version[0], version[1], i, expected, w.n, w.err)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestAutoFlowControl(t *testing.T) {
+	const initial = common.DEFAULT_INITIAL_WINDOW_SIZE
+	pressure := false
+	auto := common.NewAutoFlowControl(initial, 16*initial)
+	auto.Pressure = func() bool { return pressure }
+	auto.ObserveRTT(100 * time.Millisecond)
+
+	// Receive data at 10 MB/s, which is a
+	// 1 MB bandwidth-delay product.
+	window := int64(initial)
+	largest := window
+	for i := 0; i < 100; i++ {
+		window -= 16384
+		window += int64(auto.ReceiveData(1, initial, window))
+		if window > largest {
+			largest = window
+		}
+		time.Sleep(1600 * time.Microsecond)
+	}
+	if largest <= initial {
+		t.Fatalf("Expected the window to grow beyond %d. Got %d", initial, largest)
+	}
+	if largest > 16*initial {
+		t.Fatalf("Expected the window to stay within %d. Got %d", 16*initial, largest)
+	}
+
+	// Under pressure, the window only
+	// regrows to its initial size.
+	pressure = true
+	window = initial / 4
+	if delta := auto.ReceiveData(1, initial, window); delta != 0 && window+int64(delta) > initial {
+		t.Fatalf("Expected the window to stay within %d under memory pressure. Got %d", initial, window+int64(delta))
+	}
+
+	// The connection measures its RTT with PINGs.
+	conn, base := serveCleartext(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1<<20))
+	}), nil, 3, 1)
+	client := common.NewAutoFlowControl(common.DEFAULT_INITIAL_CLIENT_WINDOW_SIZE, 1<<26)
+	conn.(spdy.SetFlowController).SetFlowControl(client)
+
+	req, err := http.NewRequest("GET", base+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || len(body) != 1<<20 {
+		t.Fatalf("Expected %d bytes. Got %d (%v)", 1<<20, len(body), err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.RTT() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.RTT() == 0 {
+		t.Fatal("Expected the RTT to be measured.")
+	}
+}
+
+// flowRecorder is a FlowControl which records
+// the streams whose windows it regrows.
+type flowRecorder struct {
+	lock    sync.Mutex
+	streams map[common.StreamID]bool
+}
+
+func (f *flowRecorder) InitialWindowSize() uint32 {
+	return common.DEFAULT_INITIAL_WINDOW_SIZE
+}
+
+func (f *flowRecorder) ReceiveData(streamID common.StreamID, initialWindowSize uint32, newWindowSize int64) uint32 {
+	f.lock.Lock()
+	if f.streams == nil {
+		f.streams = make(map[common.StreamID]bool)
+	}
+	f.streams[streamID] = true
+	f.lock.Unlock()
+
+	if newWindowSize < int64(initialWindowSize)/2 {
+		return uint32(int64(initialWindowSize) - newWindowSize)
+	}
+	return 0
+}
+
+func (f *flowRecorder) seen() map[common.StreamID]bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.streams
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	const size = 200 << 10
+	for _, version := range [][2]int{{3, 0}, {3, 1}} {
+		server := new(flowRecorder)
+		client := new(flowRecorder)
+
+		conn, base := serveCleartext(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/upload" {
+				if err := spdy.SetStreamFlowControl(w, server); err != nil {
+					t.Error(err)
+				}
+			}
+			io.Copy(ioutil.Discard, r.Body)
+			w.Write(make([]byte, size))
+		}), nil, version[0], version[1])
+
+		// Streams 1 and 3 upload, and streams
+		// 5 and 7 download.
+		for _, path := range []string{"/upload", "/other", "/download", "/other"} {
+			req, err := http.NewRequest("POST", base+path, bytes.NewReader(make([]byte, size)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path == "/download" {
+				req = req.WithContext(common.WithFlowControl(req.Context(), client))
+			}
+			res, err := conn.RequestResponse(req, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil || len(body) != size {
+				t.Fatalf("SPDY/%d.%d: %s: Expected %d bytes. Got %d (%v)", version[0], version[1], path, size, len(body), err)
+			}
+		}
+
+		if seen := server.seen(); len(seen) != 1 || !seen[1] {
+			t.Errorf("SPDY/%d.%d: Expected server stream flow control for stream 1 only. Got %v", version[0], version[1], seen)
+		}
+		if seen := client.seen(); len(seen) != 1 || !seen[5] {
+			t.Errorf("SPDY/%d.%d: Expected client request flow control for stream 5 only. Got %v", version[0], version[1], seen)
+		}
+		conn.Close()
+	}
+}
+
+// stingyFlowControl never regrows
+// the receive window.
+type stingyFlowControl struct{}
+
+func (stingyFlowControl) InitialWindowSize() uint32 {
+	return common.DEFAULT_INITIAL_CLIENT_WINDOW_SIZE
+}
+
+func (stingyFlowControl) ReceiveData(common.StreamID, uint32, int64) uint32 {
+	return 0
+}
+
+func TestWriteBackpressure(t *testing.T) {
+	const window = common.DEFAULT_INITIAL_CLIENT_WINDOW_SIZE
+
+	type result struct {
+		n   int
+		err error
+	}
+	results := make(chan result, 1)
+	config := common.DefaultConfig()
+	config.MaxStreamBuffer = 4096
+
+	conn, base := serveConfig(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := w.Write(make([]byte, 2*window))
+		results <- result{n, err}
+	}), config, nil, 3, 0)
+	conn.(spdy.SetFlowController).SetFlowControl(stingyFlowControl{})
+
+	req, err := http.NewRequest("GET", base+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Request(req, &headerReceiver{received: make(chan struct{})}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The write fills the window and the
+	// buffer, then blocks until the deadline.
+	select {
+	case res := <-results:
+		if res.err != common.ErrTimeout {
+			t.Errorf("Expected the write to time out. Got %v", res.err)
+		}
+		if res.n > window+config.MaxStreamBuffer {
+			t.Errorf("Expected at most %d bytes written. Got %d", window+config.MaxStreamBuffer, res.n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the write to time out.")
+	}
+}
+
+func TestMemoryPressure(t *testing.T) {
+	// Under pressure, new streams are refused.
+	memory := common.NewMemoryBudget(1 << 20)
+	config := common.DefaultConfig()
+	config.MemoryBudget = memory
+	served := make(chan struct{}, 2)
+	ts := newConfigServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served <- struct{}{}
+		fmt.Fprint(w, "ok")
+	}), config)
+	defer ts.Close()
+
+	memory.Acquire(1 << 20)
+
+	client := newClient()
+	if res, err := client.Get(ts.URL); err == nil {
+		res.Body.Close()
+	}
+	select {
+	case <-served:
+		t.Error("Expected the request to be refused.")
+	default:
+	}
+	if n := memory.Stats().Refused; n != 1 {
+		t.Errorf("Expected 1 stream refused. Got %d", n)
+	}
+
+	// Once memory is released, streams are accepted.
+	memory.Release(1 << 20)
+	res, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || string(body) != "ok" {
+		t.Errorf("Expected %q. Got %q (%v)", "ok", body, err)
+	}
+	<-served
+
+	// Near the limit, WINDOW_UPDATEs are withheld until
+	// the handler has consumed the data buffered. The
+	// request body fills the server's 64 kB window,
+	// crossing 7/8 of the limit.
+	memory.Acquire(860 << 10)
+
+	upload := make([]byte, 512<<10)
+	uploads := newConfigServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for end := time.Now().Add(5 * time.Second); time.Now().Before(end); {
+			if memory.Pressure() {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		n, _ := r.Body.Read(make([]byte, 1))
+		m, _ := io.Copy(ioutil.Discard, r.Body)
+		fmt.Fprint(w, int64(n)+m)
+	}), config)
+	defer uploads.Close()
+
+	res, err = client.Post(uploads.URL, "application/octet-stream", bytes.NewReader(upload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if expected := fmt.Sprint(len(upload)); err != nil || string(body) != expected {
+		t.Errorf("Expected %s bytes received. Got %q (%v)", expected, body, err)
+	}
+	if memory.Stats().Withheld == 0 {
+		t.Error("Expected WINDOW_UPDATEs to be withheld.")
+	}
+}
+
+func TestSchedulerConfig(t *testing.T) {
+	created := make(chan struct{}, 1)
+	config := common.DefaultConfig()
+	config.Scheduler = func() common.Scheduler {
+		created <- struct{}{}
+		return common.NewPriorityScheduler()
+	}
+
+	conn, url := serveConfig(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("HELLO"))
+	}), config, nil, 3, 1)
+
+	req, err := http.NewRequest("GET", url+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := conn.RequestResponse(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "HELLO" {
+		t.Errorf("Expected HELLO. Got %q", body)
+	}
+
+	select {
+	case <-created:
+	default:
+		t.Error("Expected the configured Scheduler to be used.")
+	}
+}
+
+// gatedConn holds the writes made to a
+// connection while its gate is closed.
+type gatedConn struct {
+	net.Conn
+	gate sync.Mutex
+}
+
+func (c *gatedConn) Write(b []byte) (int, error) {
+	c.gate.Lock()
+	c.gate.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestControlFramesFirst(t *testing.T) {
+	const streams = 40
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	started := make(chan struct{}, streams)
+	gated := make(chan *gatedConn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		server := &gatedConn{Conn: c}
+		gated <- server
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			w.Write([]byte("HELLO"))
+		})
+		conn, err := spdy.NewServerConn(server, &http.Server{Handler: handler}, 3, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Run()
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := bufio.NewReader(client)
+	server := <-gated
+
+	// Wait for the server's SETTINGS, then hold
+	// its writes while the streams' frames queue.
+	if frame, err := frames.ReadFrame(buf, 0); err != nil {
+		t.Fatal(err)
+	} else if _, ok := frame.(*frames.SETTINGS); !ok {
+		t.Fatalf("Expected SETTINGS. Got %s", frame.Name())
+	}
+	server.gate.Lock()
+
+	compressor := common.NewCompressor(3)
+	defer compressor.Close()
+	for i := 0; i < streams; i++ {
+		syn := new(frames.SYN_STREAM)
+		syn.Flags = common.FLAG_FIN
+		syn.StreamID = common.StreamID(2*i + 1)
+		syn.Header = make(http.Header)
+		syn.Header.Set(":method", "GET")
+		syn.Header.Set(":path", "/")
+		syn.Header.Set(":version", "HTTP/1.1")
+		syn.Header.Set(":host", "example.com")
+		syn.Header.Set(":scheme", "http")
+		if err := syn.Compress(compressor); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := syn.WriteTo(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < streams; i++ {
+		select {
+		case <-started:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timeout waiting for handlers.")
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ping := new(frames.PING)
+	ping.PingID = 1
+	if _, err := ping.WriteTo(client); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	server.gate.Unlock()
+
+	// The PING reply overtakes the frames queued
+	// ahead of it. Only the frame being written
+	// when the gate closed may precede it.
+	for sent := 0; ; sent++ {
+		frame, err := frames.ReadFrame(buf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := frame.(*frames.PING); ok {
+			if sent > 1 {
+				t.Errorf("Expected PING reply to overtake queued frames. Got %d frames first.", sent)
+			}
+			break
+		}
+	}
+}
+
+func TestSetPriority(t *testing.T) {
+	// Handlers can demote their streams.
+	priorities := make(chan int, 1)
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := spdy.SetPriority(w, 8); err == nil {
+			t.Error("Expected priority 8 to be rejected.")
+		}
+		if err := spdy.SetPriority(w, 6); err != nil {
+			t.Error(err)
+		}
+		priority, _ := spdy.GetPriority(w)
+		priorities <- priority
+		w.Write(bytes.Repeat([]byte("x"), 256<<10))
+	}))
+	defer ts.Close()
+
+	res, err := newClient().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if err != nil || n != 256<<10 {
+		t.Errorf("Expected %d bytes. Got %d (%v)", 256<<10, n, err)
+	}
+	if priority := <-priorities; priority != 6 {
+		t.Errorf("Expected priority 6. Got %d", priority)
+	}
+
+	// Clients can change the priority of their requests.
+	conn, url := serveCleartext(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil, 3, 1)
+	req, err := http.NewRequest("GET", url+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := conn.Request(req, common.NewResponse(req, nil), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if priority := stream.(spdy.PriorityStream).Priority(); priority != 2 {
+		t.Errorf("Expected request priority 2. Got %d", priority)
+	}
+	if err := stream.(spdy.PrioritySetter).SetPriority(5); err != nil {
+		t.Fatal(err)
+	}
+	if priority := stream.(spdy.PriorityStream).Priority(); priority != 5 {
+		t.Errorf("Expected request priority 5. Got %d", priority)
+	}
+}
@@ -1,6 +1,7 @@
 package spdy
 
 import (
+	"context"
 	"io"
 	"net"
 	"net/http"
@@ -45,6 +46,11 @@ var _ = Stream(&spdy3.PushStream{})
 var _ = Stream(&spdy3.RequestStream{})
 var _ = Stream(&spdy3.ResponseStream{})
 
+var _ = http.Flusher(&spdy2.PushStream{})
+var _ = http.Flusher(&spdy2.ResponseStream{})
+var _ = http.Flusher(&spdy3.PushStream{})
+var _ = http.Flusher(&spdy3.ResponseStream{})
+
 // PriorityStream represents a SPDY stream with a priority.
 type PriorityStream interface {
 	Stream
@@ -55,8 +61,21 @@ type PriorityStream interface {
 }
 
 var _ = PriorityStream(&spdy2.ResponseStream{})
+var _ = PriorityStream(&spdy3.PushStream{})
+var _ = PriorityStream(&spdy3.RequestStream{})
 var _ = PriorityStream(&spdy3.ResponseStream{})
 
+// PrioritySetter represents a stream whose
+// priority can be changed once it has been
+// created. Only SPDY/3 streams implement it.
+type PrioritySetter interface {
+	SetPriority(common.Priority) error
+}
+
+var _ = PrioritySetter(&spdy3.PushStream{})
+var _ = PrioritySetter(&spdy3.RequestStream{})
+var _ = PrioritySetter(&spdy3.ResponseStream{})
+
 // Compressor is used to compress the text header of a SPDY frame.
 type Compressor interface {
 	io.Closer
@@ -86,11 +105,53 @@ type Pusher interface {
 var _ = Pusher(&spdy2.Conn{})
 var _ = Pusher(&spdy3.Conn{})
 
+// OptionsPusher represents something able to send
+// server pushes with PushOptions.
+type OptionsPusher interface {
+	PushWithOptions(url string, origin common.Stream, options *common.PushOptions) (common.PushStream, error)
+}
+
+var _ = OptionsPusher(&spdy2.Conn{})
+var _ = OptionsPusher(&spdy3.Conn{})
+
+// StreamHijacker represents a stream which can be
+// taken over by the handler, for use as a full-duplex
+// byte stream.
+type StreamHijacker interface {
+	HijackStream() (io.ReadWriteCloser, error)
+}
+
+var _ = StreamHijacker(&spdy2.ResponseStream{})
+var _ = StreamHijacker(&spdy3.ResponseStream{})
+
+// Tunneler represents a client connection able
+// to open tunnels through the server with CONNECT
+// requests.
+type Tunneler interface {
+	Connect(addr string) (net.Conn, error)
+	ConnectContext(ctx context.Context, addr string) (net.Conn, error)
+}
+
+var _ = Tunneler(&spdy2.Conn{})
+var _ = Tunneler(&spdy3.Conn{})
+
 // SetFlowController represents a connection
-// which can have its flow control mechanism
-// customised.
+// or stream which can have its flow control
+// mechanism customised.
 type SetFlowController interface {
 	SetFlowControl(common.FlowControl)
 }
 
 var _ = SetFlowController(&spdy3.Conn{})
+var _ = SetFlowController(&spdy3.PushStream{})
+var _ = SetFlowController(&spdy3.RequestStream{})
+var _ = SetFlowController(&spdy3.ResponseStream{})
+
+// SchedulerSetter represents a connection
+// which can have the order in which it sends
+// its streams' frames customised.
+type SchedulerSetter interface {
+	SetScheduler(common.Scheduler)
+}
+
+var _ = SchedulerSetter(&spdy3.Conn{})
@@ -6,6 +6,8 @@ package spdy
 
 import (
 	"crypto/tls"
+	"errors"
+	"io"
 	"net/http"
 	"net/url"
 	"strings"
@@ -28,8 +30,74 @@ func SetMaxBenignErrors(n int) {
 	common.MaxBenignErrors = n
 }
 
+// SetHandlerPanicHook is used to register a function that
+// is called when a handler panics, such as to pass the
+// error on to an alerting system. The function is given
+// the request being served, the value passed to panic,
+// and a stack trace.
+//
+// The stream is reset, or given a 500 response if no
+// headers have been sent, and the connection continues
+// to serve other streams. Panics with http.ErrAbortHandler
+// simply reset the stream, and are not reported.
+func SetHandlerPanicHook(hook func(r *http.Request, v interface{}, stack []byte)) {
+	common.HandlerPanicHook = hook
+}
+
+// SetHeaderLimits is used to modify the limits on the size
+// of header blocks accepted by new connections. The limits
+// are enforced as headers are decompressed, so oversized
+// headers never reach memory.
+//
+// Requests over the limits are given a 431 response, and
+// other streams are reset. Connections that exceed the
+// limits more than limits.MaxViolations times are ended
+// with a GOAWAY. If an http.Server has MaxHeaderBytes set,
+// it is used instead of limits.MaxBytes.
+func SetHeaderLimits(limits common.HeaderLimits) {
+	common.DefaultHeaderLimits = limits
+}
+
+// MemoryUsage returns the usage of the default memory
+// budget, which is shared by all connections created
+// without a Config. The usage of other budgets is given
+// by their Stats method.
+func MemoryUsage() common.MemoryStats {
+	return common.DefaultMemoryBudget.Stats()
+}
+
+// AbuseStats returns the counters of the default abuse
+// policy, such as the number of connections ended. This
+// is shared by all connections created without a Config.
+// The counters of other policies are given by their
+// Stats method.
+func AbuseStats() common.AbuseStats {
+	if policy := common.DefaultAbusePolicy; policy != nil {
+		return policy.Stats()
+	}
+	return common.AbuseStats{}
+}
+
 // AddSPDY adds SPDY support to srv, and must be called before srv begins serving.
 func AddSPDY(srv *http.Server) {
+	ConfigureServer(srv, nil)
+}
+
+// ConfigureServer adds SPDY support to srv, like AddSPDY,
+// using the given Config for each SPDY connection. This
+// allows servers to use different settings, such as their
+// own abuse policy. If config is nil, the defaults from
+// common.DefaultConfig are used. ConfigureServer must be
+// called before srv begins serving.
+//
+// A simple example of disabling abuse protection is:
+//
+//      config := common.DefaultConfig()
+//      config.AbusePolicy = nil
+//      srv := &http.Server{Addr: ":10443"}
+//      spdy.ConfigureServer(srv, config)
+//      err := srv.ListenAndServeTLS("cert.pem", "key.pem")
+func ConfigureServer(srv *http.Server, config *common.Config) {
 	if srv == nil {
 		return
 	}
@@ -66,15 +134,28 @@ func AddSPDY(srv *http.Server) {
 	for _, str := range npnStrings {
 		switch str {
 		case "spdy/2":
-			srv.TLSNextProto[str] = spdy2.NextProto
+			srv.TLSNextProto[str] = nextProto(config, 2, 0)
 		case "spdy/3":
-			srv.TLSNextProto[str] = spdy3.NextProto
+			srv.TLSNextProto[str] = nextProto(config, 3, 0)
 		case "spdy/3.1":
-			srv.TLSNextProto[str] = spdy3.NextProto1
+			srv.TLSNextProto[str] = nextProto(config, 3, 1)
 		}
 	}
 }
 
+// nextProto returns a function for use in http.Server.TLSNextProto,
+// serving the given version of SPDY using config.
+func nextProto(config *common.Config, version, subversion int) func(*http.Server, *tls.Conn, http.Handler) {
+	return func(srv *http.Server, tlsConn *tls.Conn, handler http.Handler) {
+		conn, err := NewServerConnWithConfig(tlsConn, srv, config, version, subversion)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		conn.Run()
+	}
+}
+
 // GetPriority is used to identify the request priority of the
 // given stream. This can be used to manually enforce stream
 // priority, although this is already performed by the
@@ -114,6 +195,24 @@ func GetPriority(w http.ResponseWriter) (int, error) {
 	return 0, common.ErrNotSPDY
 }
 
+// SetPriority changes the priority at which the response is
+// sent on the stream of the given http.ResponseWriter, such
+// as to demote a long download. Data already queued takes the
+// new priority. Clients can change a request's priority with
+// the PrioritySetter interface of the stream returned by
+// Conn.Request. This is supported from SPDY/3 onwards; SPDY/2
+// streams do not implement PrioritySetter, so SetPriority
+// returns common.ErrNotSPDY for them.
+func SetPriority(w http.ResponseWriter, priority int) error {
+	if stream, ok := w.(PrioritySetter); !ok {
+		return common.ErrNotSPDY
+	} else if priority < 0 {
+		return errors.New("Error: Invalid priority.")
+	} else {
+		return stream.SetPriority(common.Priority(priority))
+	}
+}
+
 // PingClient is used to send PINGs with SPDY servers.
 // PingClient takes a ResponseWriter and returns a channel on
 // which a spdy.Ping will be sent when the PING response is
@@ -265,8 +364,67 @@ func Push(w http.ResponseWriter, url string) (common.PushStream, error) {
 	}
 }
 
+// PushWithOptions is like Push, but allows the pushed request's
+// method, and the response's status, initial headers and priority
+// to be given. For example, to push a compressed script at one
+// priority level below the current response:
+//
+//      push, err := spdy.PushWithOptions(w, path, &common.PushOptions{
+//              ResponseHeader: http.Header{"Content-Encoding": {"gzip"}},
+//              Priority:       1,
+//      })
+//
+// If the underlying connection is using HTTP, and not SPDY,
+// PushWithOptions will return the ErrNotSPDY error.
+func PushWithOptions(w http.ResponseWriter, url string, options *common.PushOptions) (common.PushStream, error) {
+	stream, ok := w.(Stream)
+	if !ok {
+		return nil, common.ErrNotSPDY
+	}
+	return stream.Conn().(OptionsPusher).PushWithOptions(url, stream, options)
+}
+
+// Hijack is used to take over a SPDY stream once the request
+// headers have been received. Hijack sends the response headers
+// and returns an io.ReadWriteCloser, which reads data from the
+// client as it arrives and sends any data written back to the
+// client. Closing the stream half-closes it, so the client may
+// continue sending data until it closes its end.
+//
+// If the underlying connection is using HTTP, and not SPDY,
+// Hijack will return the ErrNotSPDY error.
+//
+// A simple example of an echo handler is:
+//
+//      import (
+//              "github.com/SlyMarbo/spdy"
+//              "io"
+//              "net/http"
+//      )
+//
+//      func httpHandler(w http.ResponseWriter, r *http.Request) {
+//              stream, err := spdy.Hijack(w)
+//              if err != nil {
+//                      // Non-SPDY connection.
+//                      return
+//              }
+//              defer stream.Close()
+//
+//              io.Copy(stream, stream)
+//      }
+func Hijack(w http.ResponseWriter) (io.ReadWriteCloser, error) {
+	if stream, ok := w.(StreamHijacker); !ok {
+		return nil, common.ErrNotSPDY
+	} else {
+		return stream.HijackStream()
+	}
+}
+
 // SetFlowControl can be used to set the flow control mechanism on
-// the underlying SPDY connection.
+// the underlying SPDY connection. This affects every stream created
+// afterwards; SetStreamFlowControl affects only the handler's own
+// stream. common.NewAutoFlowControl gives a mechanism which tunes
+// its windows to the connection's bandwidth-delay product.
 func SetFlowControl(w http.ResponseWriter, f common.FlowControl) error {
 	if stream, ok := w.(Stream); !ok {
 		return common.ErrNotSPDY
@@ -278,6 +436,22 @@ func SetFlowControl(w http.ResponseWriter, f common.FlowControl) error {
 	}
 }
 
+// SetStreamFlowControl can be used to set the flow control
+// mechanism used to receive the request body of the given
+// http.ResponseWriter's stream, leaving the rest of the
+// connection unchanged. This allows a bulk upload to use
+// larger windows than interactive requests on the same
+// connection. Clients can choose the flow control for each
+// request with common.WithFlowControl.
+func SetStreamFlowControl(w http.ResponseWriter, f common.FlowControl) error {
+	if controller, ok := w.(SetFlowController); !ok {
+		return common.ErrNotSPDY
+	} else {
+		controller.SetFlowControl(f)
+		return nil
+	}
+}
+
 // SPDYversion returns the SPDY version being used in the underlying
 // connection used by the given http.ResponseWriter. This is 0 for
 // connections not using SPDY.
@@ -6,7 +6,9 @@ package spdy2
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"net/http"
 	"net/url"
@@ -25,26 +27,33 @@ type Conn struct {
 
 	// network state
 	remoteAddr  string
+	id          uint64                            // identifies the connection in access logs.
 	server      *http.Server                      // nil if client connection.
+	config      *common.Config                    // settings for the connection.
 	conn        net.Conn                          // underlying network (TLS) connection.
 	connLock    sync.Mutex                        // protects the interface value of the above conn.
 	buf         *bufio.Reader                     // buffered reader on conn.
 	tlsState    *tls.ConnectionState              // underlying TLS connection state.
+	hostCert    *x509.Certificate                 // certificate negotiated with SNI, used to check host.
 	streams     map[common.StreamID]common.Stream // map of active streams.
 	streamsLock sync.Mutex                        // protects streams.
 	output      [8]chan common.Frame              // one output channel per priority level.
 
 	// other state
-	compressor       common.Compressor   // outbound compression state.
-	decompressor     common.Decompressor // inbound decompression state.
-	receivedSettings common.Settings     // settings sent by client.
-	goawayReceived   bool                // goaway has been received.
-	goawaySent       bool                // goaway has been sent.
-	goawayLock       sync.Mutex          // protects goawaySent and goawayReceived.
-	numBenignErrors  int                 // number of non-serious errors encountered.
-	readTimeout      time.Duration       // optional timeout for network reads.
-	writeTimeout     time.Duration       // optional timeout for network writes.
-	timeoutLock      sync.Mutex          // protects changes to readTimeout and writeTimeout.
+	compressor       common.Compressor    // outbound compression state.
+	decompressor     common.Decompressor  // inbound decompression state.
+	receivedSettings common.Settings      // settings sent by client.
+	goawayReceived   bool                 // goaway has been received.
+	goawaySent       bool                 // goaway has been sent.
+	goawayLock       sync.Mutex           // protects goawaySent and goawayReceived.
+	numBenignErrors  int                  // number of non-serious errors encountered.
+	headerLimits     common.HeaderLimits  // limits on inbound header blocks.
+	numHeaderErrors  int                  // number of header blocks over the limits.
+	abuse            *common.AbuseTracker // rate limits on the other endpoint.
+	readTimeout      time.Duration        // optional timeout for network reads.
+	writeTimeout     time.Duration        // optional timeout for network writes.
+	timeoutLock      sync.Mutex           // protects changes to readTimeout and writeTimeout.
+	memory           *common.MemoryBudget // accounts for buffered stream data.
 
 	// SPDY features
 	pings                map[uint32]chan<- bool                // response channel for pings.
@@ -52,10 +61,14 @@ type Conn struct {
 	nextPingID           uint32                                // next outbound ping ID.
 	nextPingIDLock       sync.Mutex                            // protects nextPingID.
 	pushStreamLimit      *common.StreamLimit                   // Limit on streams started by the server.
-	pushRequests         map[common.StreamID]*http.Request     // map of requests sent in server pushes.
+	pushes               map[common.StreamID]*receivedPush     // pushes received from the server.
 	lastPushStreamID     common.StreamID                       // last push stream ID. (even)
 	lastPushStreamIDLock sync.Mutex                            // protects lastPushStreamID.
 	pushedResources      map[common.Stream]map[string]struct{} // prevents duplicate headers being pushed.
+	pushedResourcesLock  sync.Mutex                            // protects pushedResources.
+	pushAccount          *common.PushAccount                   // limits on pushes sent.
+	preloaded            map[string]struct{}                   // resources pushed from Link headers.
+	preloadedLock        sync.Mutex                            // protects preloaded.
 
 	// requests
 	lastRequestStreamID     common.StreamID     // last request stream ID. (odd)
@@ -72,15 +85,26 @@ type Conn struct {
 	sendingLock  sync.Mutex    // protects changes to sending's value.
 	init         func()        // this function is called before the connection begins.
 	shutdownOnce sync.Once     // used to ensure clean shutdown.
+
+	// request contexts
+	baseContext   context.Context    // parent of each request's context.
+	cancelContext context.CancelFunc // cancels baseContext when the connection closes.
 }
 
-// NewConn produces an initialised spdy3 connection.
-func NewConn(conn net.Conn, server *http.Server) *Conn {
+// NewConn produces an initialised spdy2 connection. If
+// config is nil, the defaults from common.DefaultConfig
+// are used.
+func NewConn(conn net.Conn, server *http.Server, config *common.Config) *Conn {
 	out := new(Conn)
 
 	// Common ground.
+	out.id = common.NextConnID()
 	out.remoteAddr = conn.RemoteAddr().String()
 	out.server = server
+	out.config = config
+	if config == nil {
+		out.config = common.DefaultConfig()
+	}
 	out.conn = conn
 	out.buf = bufio.NewReader(conn)
 	if tlsConn, ok := conn.(*tls.Conn); ok {
@@ -98,14 +122,28 @@ func NewConn(conn net.Conn, server *http.Server) *Conn {
 	out.output[7] = make(chan common.Frame)
 	out.pings = make(map[uint32]chan<- bool)
 	out.compressor = common.NewCompressor(2)
-	out.decompressor = common.NewDecompressor(2)
+	out.headerLimits = common.DefaultHeaderLimits
+	if server != nil && server.MaxHeaderBytes > 0 {
+		out.headerLimits.MaxBytes = server.MaxHeaderBytes
+	}
+	out.decompressor = common.NewDecompressorWithLimits(2, out.headerLimits)
+	if policy := out.config.AbusePolicy; policy != nil {
+		out.abuse = policy.Track(conn.RemoteAddr())
+	}
 	out.receivedSettings = make(common.Settings)
 	out.lastPushStreamID = 0
 	out.lastRequestStreamID = 0
 	out.stop = make(chan bool)
+	out.memory = out.config.MemoryBudget
+	if out.memory == nil {
+		out.memory = common.DefaultMemoryBudget
+	}
+	out.baseContext, out.cancelContext = context.WithCancel(context.Background())
 
 	// Server/client specific.
 	if server != nil { // servers
+		out.baseContext = context.WithValue(out.baseContext, http.ServerContextKey, server)
+		out.baseContext = context.WithValue(out.baseContext, http.LocalAddrContextKey, conn.LocalAddr())
 		out.nextPingID = 2
 		out.oddity = 0
 		out.initialWindowSize = common.DEFAULT_INITIAL_WINDOW_SIZE
@@ -124,6 +162,14 @@ func NewConn(conn net.Conn, server *http.Server) *Conn {
 			out.SetWriteTimeout(d)
 		}
 		out.pushedResources = make(map[common.Stream]map[string]struct{})
+		out.pushAccount = common.NewPushAccount(out.config.PushBudget)
+		out.preloaded = make(map[string]struct{})
+
+		// Virtual hosts are checked against the
+		// certificate chosen for the connection.
+		if _, ok := server.Handler.(common.HostRouter); ok && out.tlsState != nil {
+			out.hostCert = common.NegotiatedCertificate(server.TLSConfig, out.tlsState.ServerName)
+		}
 
 	} else { // clients
 		out.nextPingID = 1
@@ -131,7 +177,7 @@ func NewConn(conn net.Conn, server *http.Server) *Conn {
 		out.initialWindowSize = common.DEFAULT_INITIAL_CLIENT_WINDOW_SIZE
 		out.requestStreamLimit = common.NewStreamLimit(common.NO_STREAM_LIMIT)
 		out.pushStreamLimit = common.NewStreamLimit(common.DEFAULT_STREAM_LIMIT)
-		out.pushRequests = make(map[common.StreamID]*http.Request)
+		out.pushes = make(map[common.StreamID]*receivedPush)
 		out.init = func() {
 			// Initialise the connection by sending the connection settings.
 			settings := new(frames.SETTINGS)
@@ -145,7 +191,7 @@ func NewConn(conn net.Conn, server *http.Server) *Conn {
 // NextProto is intended for use in http.Server.TLSNextProto,
 // using SPDY/2 for the connection.
 func NextProto(s *http.Server, tlsConn *tls.Conn, handler http.Handler) {
-	NewConn(tlsConn, s).Run()
+	NewConn(tlsConn, s, nil).Run()
 }
 
 func (c *Conn) Run() error {
@@ -161,12 +207,27 @@ func (c *Conn) Run() error {
 // newStream is used to create a new serverStream from a SYN_STREAM frame.
 func (c *Conn) newStream(frame *frames.SYN_STREAM) *ResponseStream {
 	header := frame.Header
+	method := header.Get("method")
 	rawUrl := header.Get("scheme") + "://" + header.Get("host") + header.Get("url")
 
+	// CONNECT requests give only the
+	// host and port to connect to.
+	if method == "CONNECT" {
+		rawUrl = "//" + header.Get("url")
+	}
+
 	url, err := url.Parse(rawUrl)
 	if c.check(err != nil, "Received SYN_STREAM with invalid request URL (%v)", err) {
 		return nil
 	}
+	requestURI := url.RequestURI()
+	if method == "CONNECT" {
+		_, _, err = net.SplitHostPort(url.Host)
+		if c.check(err != nil, "Received CONNECT with invalid address (%v)", err) {
+			return nil
+		}
+		requestURI = url.Host
+	}
 
 	vers := header.Get("version")
 	major, minor, ok := http.ParseHTTPVersion(vers)
@@ -174,8 +235,6 @@ func (c *Conn) newStream(frame *frames.SYN_STREAM) *ResponseStream {
 		return nil
 	}
 
-	method := header.Get("method")
-
 	// Build this into a request to present to the Handler.
 	request := &http.Request{
 		Method:     method,
@@ -186,14 +245,38 @@ func (c *Conn) newStream(frame *frames.SYN_STREAM) *ResponseStream {
 		RemoteAddr: c.remoteAddr,
 		Header:     header,
 		Host:       url.Host,
-		RequestURI: url.RequestURI(),
+		RequestURI: requestURI,
 		TLS:        c.tlsState,
 	}
 
+	handler := c.hostHandler(url.Host)
+	if handler == nil {
+		log.Printf("Warning: Refused stream %d for host %q from %s.\n", frame.StreamID, url.Host, c.remoteAddr)
+		c._RST_STREAM(frame.StreamID, common.RST_STREAM_REFUSED_STREAM)
+		return nil
+	}
+
 	output := c.output[frame.Priority]
 	c.streamCreation.Lock()
-	out := NewResponseStream(c, frame, output, c.server.Handler, request)
+	out := NewResponseStream(c, frame, output, handler, request)
 	c.streamCreation.Unlock()
 
 	return out
 }
+
+// hostHandler returns the Handler for streams to the
+// given host, or nil if the stream should be refused.
+// If the server's Handler is a common.HostRouter, the
+// host must be covered by the connection's certificate.
+// Over TLS, streams are refused if the certificate is
+// not known.
+func (c *Conn) hostHandler(host string) http.Handler {
+	router, ok := c.server.Handler.(common.HostRouter)
+	if !ok {
+		return c.server.Handler
+	}
+	if c.tlsState != nil && (c.hostCert == nil || !common.CoversHost(c.hostCert, host)) {
+		return nil
+	}
+	return router.HostHandler(host)
+}
@@ -0,0 +1,242 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy2/frames"
+)
+
+// Connect is used to open a tunnel to the given host and
+// port through the server, using a CONNECT request. Data
+// written to the returned net.Conn is sent in DATA frames,
+// and CloseWrite half-closes the stream.
+func (c *Conn) Connect(addr string) (net.Conn, error) {
+	return c.ConnectContext(context.Background(), addr)
+}
+
+// ConnectContext is like Connect, but gives up waiting
+// for the server's response once ctx is done. Once the
+// tunnel has been opened, ctx has no effect on it.
+func (c *Conn) ConnectContext(ctx context.Context, addr string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.goawayLock.Lock()
+	goaway := c.goawayReceived || c.goawaySent
+	c.goawayLock.Unlock()
+	if goaway {
+		return nil, common.ErrGoaway
+	}
+
+	if c.server != nil {
+		return nil, errors.New("Error: Only clients can send requests.")
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, err
+	}
+
+	// Check stream limit would allow the new stream.
+	if !c.requestStreamLimit.Add() {
+		return nil, errors.New("Error: Max concurrent streams limit exceeded.")
+	}
+
+	// Prepare the SYN_STREAM.
+	syn := new(frames.SYN_STREAM)
+	syn.Header = make(http.Header)
+	syn.Header.Set("method", "CONNECT")
+	syn.Header.Set("url", addr)
+	syn.Header.Set("version", "HTTP/1.1")
+	syn.Header.Set("host", addr)
+
+	request := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: addr},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       addr,
+		RequestURI: addr,
+	}
+	request = request.WithContext(ctx)
+
+	tunnel := new(connectConn)
+	tunnel.body = common.NewPipeWithBudget(c.memory)
+	tunnel.reply = make(chan http.Header, 1)
+	tunnel.localAddr = c.conn.LocalAddr()
+	tunnel.remoteAddr = c.conn.RemoteAddr()
+
+	// Send.
+	c.streamCreation.Lock()
+	c.lastRequestStreamIDLock.Lock()
+	if c.lastRequestStreamID == 0 {
+		c.lastRequestStreamID = 1
+	} else {
+		c.lastRequestStreamID += 2
+	}
+	syn.StreamID = c.lastRequestStreamID
+	c.lastRequestStreamIDLock.Unlock()
+	if syn.StreamID > common.MAX_STREAM_ID {
+		c.streamCreation.Unlock()
+		c.requestStreamLimit.Close()
+		return nil, errors.New("Error: All client streams exhausted.")
+	}
+	c.output[0] <- syn
+
+	// Create the request stream.
+	stream := NewRequestStream(c, syn.StreamID, c.output[0])
+	stream.Request = request
+	stream.Receiver = tunnel
+	tunnel.stream = stream
+	c.streamsLock.Lock()
+	c.streams[syn.StreamID] = stream // Store in the connection map.
+	c.streamsLock.Unlock()
+	c.streamCreation.Unlock()
+
+	go tunnel.wait()
+
+	// Wait for the server's response.
+	select {
+	case header := <-tunnel.reply:
+		status := strings.SplitN(header.Get("status"), " ", 2)[0]
+		if code, err := strconv.Atoi(status); err != nil || code/100 != 2 {
+			tunnel.Close()
+			return nil, fmt.Errorf("Error: CONNECT to %s failed with status %q.", addr, header.Get("status"))
+		}
+	case <-stream.finished:
+		tunnel.Close()
+		return nil, common.ErrConnectFail
+	case <-ctx.Done():
+		tunnel.Close()
+		return nil, ctx.Err()
+	}
+
+	return tunnel, nil
+}
+
+// connectConn is the net.Conn returned by
+// Conn.Connect. It is also the stream's
+// Receiver.
+type connectConn struct {
+	sync.Mutex
+	stream        *RequestStream
+	body          *common.Pipe
+	reply         chan http.Header
+	replyOnce     sync.Once
+	writeClosed   bool
+	writeDeadline time.Time
+	localAddr     net.Addr
+	remoteAddr    net.Addr
+}
+
+// wait closes the body once the stream has
+// finished, such as if it is reset.
+func (t *connectConn) wait() {
+	<-t.stream.finished
+	t.body.CloseWithError(common.ErrStreamClosed)
+}
+
+func (t *connectConn) ReceiveData(_ *http.Request, data []byte, final bool) {
+	t.body.Write(data)
+	if final {
+		t.body.CloseWithError(nil)
+	}
+}
+
+func (t *connectConn) ReceiveHeader(_ *http.Request, header http.Header) {
+	t.replyOnce.Do(func() {
+		t.reply <- header
+	})
+}
+
+func (t *connectConn) ReceiveRequest(*http.Request) bool {
+	return false
+}
+
+func (t *connectConn) Read(b []byte) (int, error) {
+	return t.body.Read(b)
+}
+
+func (t *connectConn) Write(b []byte) (int, error) {
+	t.Lock()
+	closed, deadline := t.writeClosed, t.writeDeadline
+	t.Unlock()
+	if closed {
+		return 0, common.ErrStreamClosed
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, common.ErrTimeout
+	}
+	return t.stream.Write(b)
+}
+
+// CloseWrite half-closes the stream, sending
+// FIN. The server may continue to send data.
+func (t *connectConn) CloseWrite() error {
+	t.Lock()
+	closed := t.writeClosed
+	t.writeClosed = true
+	t.Unlock()
+	if closed || t.stream.closed() || t.stream.state.ClosedHere() {
+		return nil
+	}
+
+	data := new(frames.DATA)
+	data.StreamID = t.stream.streamID
+	data.Flags = common.FLAG_FIN
+	data.Data = []byte{}
+	t.stream.output <- data
+	t.stream.state.CloseHere()
+	return nil
+}
+
+// Close half-closes the stream, and resets
+// it if the server has not finished.
+func (t *connectConn) Close() error {
+	t.CloseWrite()
+	t.body.Close()
+	return t.stream.Close()
+}
+
+func (t *connectConn) LocalAddr() net.Addr {
+	return t.localAddr
+}
+
+func (t *connectConn) RemoteAddr() net.Addr {
+	return t.remoteAddr
+}
+
+func (t *connectConn) SetDeadline(d time.Time) error {
+	t.SetReadDeadline(d)
+	return t.SetWriteDeadline(d)
+}
+
+func (t *connectConn) SetReadDeadline(d time.Time) error {
+	t.body.SetReadDeadline(d)
+	return nil
+}
+
+// SetWriteDeadline sets the time after which
+// writes fail.
+func (t *connectConn) SetWriteDeadline(d time.Time) error {
+	t.Lock()
+	t.writeDeadline = d
+	t.Unlock()
+	return nil
+}
@@ -44,6 +44,12 @@ func (c *Conn) readFrames() {
 
 		// Decompress the frame's headers, if there are any.
 		err = frame.Decompress(c.decompressor)
+		if limitErr, ok := err.(*common.HeaderLimitError); ok {
+			if c.handleHeaderLimit(frame, limitErr) {
+				return
+			}
+			continue
+		}
 		if err != nil {
 			log.Printf("Error in decompression: %v (%T).\n", err, frame)
 			c.protocolError(0)
@@ -156,7 +162,7 @@ func (c *Conn) selectFrameToSend(prioritise bool) (frame common.Frame) {
 		return frame
 	case frame = <-c.output[2]:
 		return frame
-	case frame = <-c.output[2]:
+	case frame = <-c.output[3]:
 		return frame
 	case frame = <-c.output[4]:
 		return frame
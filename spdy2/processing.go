@@ -1,6 +1,7 @@
 package spdy2
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 
@@ -16,6 +17,9 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 	switch frame := frame.(type) {
 
 	case *frames.SYN_STREAM:
+		if c.abusive(common.AbuseStream) {
+			return true
+		}
 		if c.server == nil {
 			c.handlePush(frame)
 		} else {
@@ -26,6 +30,10 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 		c.handleSynReply(frame)
 
 	case *frames.RST_STREAM:
+		if c.abusive(common.AbuseReset) {
+			return true
+		}
+		c.recordReset(frame.StreamID, frame.Status)
 		if frame.Status.IsFatal() {
 			code := frame.Status.String()
 			c.check(true, "Received %s on stream %d. Closing connection", code, frame.StreamID)
@@ -35,6 +43,9 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 		c.handleRstStream(frame)
 
 	case *frames.SETTINGS:
+		if c.abusive(common.AbuseSettings) {
+			return true
+		}
 		for _, setting := range frame.Settings {
 			c.receivedSettings[setting.ID] = setting
 			switch setting.ID {
@@ -71,6 +82,9 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 			delete(c.pings, frame.PingID)
 			c.pingsLock.Unlock()
 		} else {
+			if c.abusive(common.AbusePing) {
+				return true
+			}
 			debug.Println("Received PING. Replying...")
 			c.output[0] <- frame
 		}
@@ -147,8 +161,12 @@ func (c *Conn) handleHeaders(frame *frames.HEADERS) {
 	// Handle push headers.
 	if sid&1 == 0 && c.server == nil {
 		// Ignore refused push headers.
-		if req := c.pushRequests[sid]; req != nil && c.PushReceiver != nil {
-			c.PushReceiver.ReceiveHeader(req, frame.Header)
+		if push := c.pushes[sid]; push != nil {
+			push.receiver.ReceiveHeader(push.request, frame.Header)
+			if frame.Flags.FIN() {
+				push.receiver.ReceiveData(push.request, nil, true)
+				c.endPush(sid, nil)
+			}
 		}
 		return
 	}
@@ -204,6 +222,13 @@ func (c *Conn) handlePush(frame *frames.SYN_STREAM) {
 
 	// Stream ID is fine.
 
+	// Refuse the stream while memory is scarce.
+	if c.memory.Pressure() {
+		c.memory.Refused()
+		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
+		return
+	}
+
 	// Check stream limit would allow the new stream.
 	if !c.pushStreamLimit.Add() {
 		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
@@ -244,20 +269,72 @@ func (c *Conn) handlePush(frame *frames.SYN_STREAM) {
 		TLS:        c.tlsState,
 	}
 
+	// Pushes go to the push receiver of the request
+	// they are associated with, if it has one, and
+	// are refused once that request has finished.
+	var assoc *http.Request
+	c.streamsLock.Lock()
+	stream, ok := c.streams[frame.AssocStreamID].(*RequestStream)
+	c.streamsLock.Unlock()
+	if ok {
+		assoc = stream.pushRequest()
+	}
+	receiver := c.PushReceiver
+	if assoc != nil {
+		if r := common.PushReceiverFromContext(assoc.Context()); r != nil {
+			receiver = r
+		}
+	}
+	if receiver == nil || assoc == nil {
+		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
+		c.pushStreamLimit.Close()
+		return
+	}
+
+	// The pushed request's context carries the
+	// associated request, and ends with the push.
+	ctx := common.ContextWithAssociatedRequest(c.baseContext, assoc)
+	ctx, cancel := context.WithCancelCause(ctx)
+	request = request.WithContext(ctx)
+	c.pushes[sid] = &receivedPush{request: request, receiver: receiver, cancel: cancel}
+
 	// Check whether the receiver wants this resource.
-	if c.PushReceiver != nil && !c.PushReceiver.ReceiveRequest(request) {
+	if !receiver.ReceiveRequest(request) {
 		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
+		c.endPush(sid, nil)
 		return
 	}
 
 	// Create and start new stream.
-	if c.PushReceiver != nil {
-		c.pushRequests[sid] = request
-		c.lastPushStreamIDLock.Lock()
-		c.lastPushStreamID = sid
-		c.lastPushStreamIDLock.Unlock()
-		c.PushReceiver.ReceiveHeader(request, frame.Header)
+	c.lastPushStreamIDLock.Lock()
+	c.lastPushStreamID = sid
+	c.lastPushStreamIDLock.Unlock()
+	receiver.ReceiveHeader(request, frame.Header)
+	if frame.Flags.FIN() {
+		receiver.ReceiveData(request, nil, true)
+		c.endPush(sid, nil)
+	}
+}
+
+// receivedPush is the state of a push
+// received from the server.
+type receivedPush struct {
+	request  *http.Request
+	receiver common.Receiver
+	cancel   context.CancelCauseFunc // ends the request's context.
+}
+
+// endPush releases the state of a push received
+// from the server, ending its request's context
+// with the given cause.
+func (c *Conn) endPush(sid common.StreamID, cause error) {
+	push := c.pushes[sid]
+	if push == nil {
+		return
 	}
+	push.cancel(cause)
+	delete(c.pushes, sid)
+	c.pushStreamLimit.Close()
 }
 
 // handleRequest performs the processing of SYN_STREAM request frames.
@@ -296,6 +373,13 @@ func (c *Conn) handleRequest(frame *frames.SYN_STREAM) {
 
 	// Stream ID is fine.
 
+	// Refuse the stream while memory is scarce.
+	if c.memory.Pressure() {
+		c.memory.Refused()
+		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
+		return
+	}
+
 	// Check stream limit would allow the new stream.
 	if !c.requestStreamLimit.Add() {
 		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
@@ -312,6 +396,7 @@ func (c *Conn) handleRequest(frame *frames.SYN_STREAM) {
 	nextStream := c.newStream(frame)
 	// Make sure an error didn't occur when making the stream.
 	if nextStream == nil {
+		c.requestStreamLimit.Close()
 		return
 	}
 
@@ -334,6 +419,19 @@ func (c *Conn) handleRstStream(frame *frames.RST_STREAM) {
 	stream := c.streams[sid]
 	c.streamsLock.Unlock()
 
+	// Tell the pusher why the push ended.
+	if push, ok := stream.(*PushStream); ok {
+		if frame.Status == common.RST_STREAM_CANCEL || frame.Status == common.RST_STREAM_REFUSED_STREAM {
+			c.pushAccount.Refused()
+		}
+		push.reset(frame.Status)
+	}
+
+	// End pushes received from the server.
+	if c.server == nil && sid&1 == 0 {
+		c.endPush(sid, &common.StreamResetError{StreamID: sid, Status: frame.Status})
+	}
+
 	// Determine the status code and react accordingly.
 	switch frame.Status {
 	case common.RST_STREAM_INVALID_STREAM,
@@ -352,7 +450,8 @@ func (c *Conn) handleRstStream(frame *frames.RST_STREAM) {
 			return
 		}
 		fallthrough
-	case common.RST_STREAM_REFUSED_STREAM:
+	case common.RST_STREAM_REFUSED_STREAM,
+		common.RST_STREAM_INTERNAL_ERROR:
 		if stream != nil {
 			go stream.Close()
 		}
@@ -369,8 +468,11 @@ func (c *Conn) handleServerData(frame *frames.DATA) {
 	// Handle push data.
 	if sid&1 == 0 {
 		// Ignore refused push data.
-		if req := c.pushRequests[sid]; req != nil && c.PushReceiver != nil {
-			c.PushReceiver.ReceiveData(req, frame.Data, frame.Flags.FIN())
+		if push := c.pushes[sid]; push != nil {
+			push.receiver.ReceiveData(push.request, frame.Data, frame.Flags.FIN())
+			if frame.Flags.FIN() {
+				c.endPush(sid, nil)
+			}
 		}
 		return
 	}
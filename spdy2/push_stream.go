@@ -5,6 +5,7 @@
 package spdy2
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -23,10 +24,16 @@ type PushStream struct {
 	conn         *Conn
 	streamID     common.StreamID
 	origin       common.Stream
+	originID     common.StreamID
 	state        *common.StreamState
 	output       chan<- common.Frame
 	header       http.Header
 	stop         <-chan bool
+	record       *common.StreamRecorder
+	ctx          context.Context
+	cancel       context.CancelFunc
+	err          error      // set if the client resets the push.
+	errLock      sync.Mutex // protects err.
 }
 
 func NewPushStream(conn *Conn, streamID common.StreamID, origin common.Stream, output chan<- common.Frame) *PushStream {
@@ -34,10 +41,12 @@ func NewPushStream(conn *Conn, streamID common.StreamID, origin common.Stream, o
 	out.conn = conn
 	out.streamID = streamID
 	out.origin = origin
+	out.originID = origin.StreamID()
 	out.output = output
 	out.stop = conn.stop
 	out.state = new(common.StreamState)
 	out.header = make(http.Header)
+	out.ctx, out.cancel = context.WithCancel(conn.baseContext)
 	return out
 }
 
@@ -51,6 +60,9 @@ func (p *PushStream) Header() http.Header {
 
 // Write is used for sending data in the push.
 func (p *PushStream) Write(inputData []byte) (int, error) {
+	if err := p.Err(); err != nil {
+		return 0, err
+	}
 	if p.closed() || p.state.ClosedHere() {
 		return 0, errors.New("Error: Stream already closed.")
 	}
@@ -60,6 +72,14 @@ func (p *PushStream) Write(inputData []byte) (int, error) {
 		return 0, errors.New("Error: Origin stream is closed.")
 	}
 
+	// Only as much data as the push
+	// budget allows is sent.
+	allowed, budgetErr := p.conn.pushAccount.Reserve(p.originID, len(inputData))
+	if allowed == 0 && budgetErr != nil {
+		return 0, budgetErr
+	}
+	inputData = inputData[:allowed]
+
 	p.writeHeader()
 
 	// Copy the data locally to avoid any pointer issues.
@@ -75,11 +95,13 @@ func (p *PushStream) Write(inputData []byte) (int, error) {
 		p.output <- dataFrame
 
 		written += common.MAX_DATA_SIZE
+		data = data[common.MAX_DATA_SIZE:]
 	}
 
 	n := len(data)
 	if n == 0 {
-		return written, nil
+		p.record.Sent(written)
+		return written, budgetErr
 	}
 
 	dataFrame := new(frames.DATA)
@@ -87,7 +109,8 @@ func (p *PushStream) Write(inputData []byte) (int, error) {
 	dataFrame.Data = data
 	p.output <- dataFrame
 
-	return written + n, nil
+	p.record.Sent(written + n)
+	return written + n, budgetErr
 }
 
 // WriteHeader is provided to satisfy the Stream
@@ -97,6 +120,20 @@ func (p *PushStream) WriteHeader(int) {
 	return
 }
 
+/****************
+ * http.Flusher *
+ ****************/
+
+// Flush sends any pending headers to the client
+// immediately.
+func (p *PushStream) Flush() {
+	if p.closed() || p.state.ClosedHere() {
+		return
+	}
+
+	p.writeHeader()
+}
+
 /*****************
  * io.Closer *
  *****************/
@@ -109,6 +146,8 @@ func (p *PushStream) Close() error {
 }
 
 func (p *PushStream) shutdown() {
+	p.cancel()
+	p.record.Finish(common.StreamGoaway, 0)
 	p.writeHeader()
 	if p.state != nil {
 		p.state.Close()
@@ -168,15 +207,38 @@ func (p *PushStream) StreamID() common.StreamID {
  **************/
 
 func (p *PushStream) Finish() {
+	if p.Err() != nil || p.closed() || p.state.ClosedHere() {
+		p.Close()
+		return
+	}
+
 	p.writeHeader()
 	end := new(frames.DATA)
 	end.StreamID = p.streamID
 	end.Data = []byte{}
 	end.Flags = common.FLAG_FIN
 	p.output <- end
+	p.record.Finish(common.StreamFinished, 0)
 	p.Close()
 }
 
+// Context returns a context that is done once
+// the push has ended, such as when the client
+// cancels or refuses it, or the connection
+// closes. Handlers generating pushed content
+// can use it to stop early.
+func (p *PushStream) Context() context.Context {
+	return p.ctx
+}
+
+// Err returns a *common.StreamResetError if the
+// client has reset the push, or nil otherwise.
+func (p *PushStream) Err() error {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	return p.err
+}
+
 /**********
  * Others *
  **********/
@@ -208,3 +270,18 @@ func (p *PushStream) writeHeader() {
 	}
 	p.output <- header
 }
+
+func (p *PushStream) accessRecord() *common.StreamRecorder {
+	return p.record
+}
+
+// reset records that the client has reset
+// the push, and ends its context.
+func (p *PushStream) reset(status common.StatusCode) {
+	p.errLock.Lock()
+	if p.err == nil {
+		p.err = &common.StreamResetError{StreamID: p.streamID, Status: status}
+	}
+	p.errLock.Unlock()
+	p.cancel()
+}
@@ -24,12 +24,14 @@ type RequestStream struct {
 
 	recvMutex    sync.Mutex
 	shutdownOnce sync.Once
+	finishOnce   sync.Once
 	conn         *Conn
 	streamID     common.StreamID
 	state        *common.StreamState
 	output       chan<- common.Frame
 	header       http.Header
 	headerChan   chan func()
+	closing      chan struct{} // closed once the stream starts to close.
 	responseCode int
 	stop         <-chan bool
 	finished     chan struct{}
@@ -42,10 +44,10 @@ func NewRequestStream(conn *Conn, streamID common.StreamID, output chan<- common
 	out.output = output
 	out.stop = conn.stop
 	out.state = new(common.StreamState)
-	out.state.CloseHere()
 	out.header = make(http.Header)
 	out.finished = make(chan struct{})
 	out.headerChan = make(chan func(), 5)
+	out.closing = make(chan struct{})
 	go out.processFrames()
 	return out
 }
@@ -80,6 +82,7 @@ func (s *RequestStream) Write(inputData []byte) (int, error) {
 		s.output <- dataFrame
 
 		written += common.MAX_DATA_SIZE
+		data = data[common.MAX_DATA_SIZE:]
 	}
 
 	n := len(data)
@@ -125,19 +128,19 @@ func (s *RequestStream) shutdown() {
 		}
 		s.state.Close()
 	}
-	select {
-	case <-s.finished:
-	default:
-		close(s.finished)
-	}
-	select {
-	case <-s.headerChan:
-	default:
-		close(s.headerChan)
-	}
-	s.output = nil
+
+	// Frames already received are still
+	// passed to the Receiver, and the stream
+	// is finished once they have been. This
+	// does not wait, as Close may be called
+	// by the Receiver.
+	close(s.closing)
+	s.recvMutex.Lock()
+	close(s.headerChan)
 	s.Request = nil
 	s.Receiver = nil
+	s.recvMutex.Unlock()
+	s.output = nil
 	s.header = nil
 	s.stop = nil
 }
@@ -158,6 +161,14 @@ func (s *RequestStream) ReceiveFrame(frame common.Frame) error {
 		return errors.New("Nil frame received.")
 	}
 
+	if s.closed() {
+		return errors.New("Error: Stream already closed.")
+	}
+
+	// The Receiver is called in order, but may be
+	// called after the stream has been closed.
+	receiver, request := s.Receiver, s.Request
+
 	// Process the frame depending on its type.
 	switch frame := frame.(type) {
 	case *frames.DATA:
@@ -169,34 +180,34 @@ func (s *RequestStream) ReceiveFrame(frame common.Frame) error {
 		}
 
 		// Give to the client.
-		s.headerChan <- func() {
-			s.Receiver.ReceiveData(s.Request, data, frame.Flags.FIN())
+		s.deliver(func() {
+			receiver.ReceiveData(request, data, frame.Flags.FIN())
 
 			if frame.Flags.FIN() {
 				s.state.CloseThere()
-				close(s.finished)
+				s.finish()
 			}
-		}
+		})
 
 	case *frames.SYN_REPLY:
-		s.headerChan <- func() {
-			s.Receiver.ReceiveHeader(s.Request, frame.Header)
+		s.deliver(func() {
+			receiver.ReceiveHeader(request, frame.Header)
 
 			if frame.Flags.FIN() {
 				s.state.CloseThere()
-				close(s.finished)
+				s.finish()
 			}
-		}
+		})
 
 	case *frames.HEADERS:
-		s.headerChan <- func() {
-			s.Receiver.ReceiveHeader(s.Request, frame.Header)
+		s.deliver(func() {
+			receiver.ReceiveHeader(request, frame.Header)
 
 			if frame.Flags.FIN() {
 				s.state.CloseThere()
-				close(s.finished)
+				s.finish()
 			}
-		}
+		})
 
 	case *frames.WINDOW_UPDATE:
 		// Ignore.
@@ -225,6 +236,14 @@ func (s *RequestStream) Run() error {
 	return nil
 }
 
+// finish is used to signal that the
+// response has been received in full.
+func (s *RequestStream) finish() {
+	s.finishOnce.Do(func() {
+		close(s.finished)
+	})
+}
+
 func (s *RequestStream) State() *common.StreamState {
 	return s.state
 }
@@ -264,8 +283,31 @@ func (s *RequestStream) writeHeader() {
 	s.output <- header
 }
 
+// deliver queues f to be called by processFrames,
+// unless the stream is closing. The recvMutex must
+// be held.
+func (s *RequestStream) deliver(f func()) {
+	select {
+	case s.headerChan <- f:
+	case <-s.closing:
+	}
+}
+
 func (s *RequestStream) processFrames() {
+	defer s.finish()
 	for f := range s.headerChan {
 		f()
 	}
 }
+
+// pushRequest returns the stream's request, or
+// nil if the stream has finished, so server
+// pushes can no longer be associated with it.
+func (s *RequestStream) pushRequest() *http.Request {
+	s.recvMutex.Lock()
+	defer s.recvMutex.Unlock()
+	if s.state.ClosedThere() {
+		return nil
+	}
+	return s.Request
+}
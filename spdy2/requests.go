@@ -122,6 +122,7 @@ func (c *Conn) Request(request *http.Request, receiver common.Receiver, priority
 	out := NewRequestStream(c, syn.StreamID, c.output[0])
 	out.Request = request
 	out.Receiver = receiver
+	out.state.CloseHere()
 
 	// Store in the connection map.
 	c.streamsLock.Lock()
@@ -5,9 +5,10 @@
 package spdy2
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"sync"
@@ -25,7 +26,7 @@ type ResponseStream struct {
 	shutdownOnce   sync.Once
 	conn           *Conn
 	streamID       common.StreamID
-	requestBody    *bytes.Buffer
+	requestBody    *common.Pipe
 	state          *common.StreamState
 	output         chan<- common.Frame
 	request        *http.Request
@@ -34,9 +35,13 @@ type ResponseStream struct {
 	priority       common.Priority
 	unidirectional bool
 	responseCode   int
-	ready          chan struct{}
 	stop           chan bool
+	closeNotify    chan bool
+	cancel         context.CancelFunc
 	wroteHeader    bool
+	hijacked       bool
+	pushes         sync.WaitGroup // preloaded resources being pushed.
+	record         *common.StreamRecorder
 }
 
 func NewResponseStream(conn *Conn, frame *frames.SYN_STREAM, output chan<- common.Frame, handler http.Handler, request *http.Request) *ResponseStream {
@@ -48,21 +53,27 @@ func NewResponseStream(conn *Conn, frame *frames.SYN_STREAM, output chan<- commo
 	if out.handler == nil {
 		out.handler = http.DefaultServeMux
 	}
-	out.request = request
+	out.closeNotify = make(chan bool)
+
+	// The request's context is cancelled if the
+	// stream is reset or the connection closes.
+	ctx, cancel := context.WithCancel(conn.baseContext)
+	out.request = request.WithContext(ctx)
+	out.cancel = cancel
 	out.priority = frame.Priority
 	out.stop = conn.stop
 	out.unidirectional = frame.Flags.UNIDIRECTIONAL()
-	out.requestBody = new(bytes.Buffer)
+	out.record = common.NewStreamRecorder(conn.config.AccessLogger, conn.id, frame.StreamID, conn.version(), frame.Priority, out.request, false)
+	out.requestBody = common.NewPipeWithBudget(conn.memory)
 	out.state = new(common.StreamState)
 	out.header = make(http.Header)
 	out.responseCode = 0
-	out.ready = make(chan struct{})
 	out.wroteHeader = false
 	if frame.Flags.FIN() {
-		close(out.ready)
+		out.requestBody.CloseWithError(nil)
 		out.state.CloseThere()
 	}
-	out.request.Body = &common.ReadCloser{out.requestBody}
+	out.request.Body = out.requestBody
 	return out
 }
 
@@ -105,10 +116,12 @@ func (s *ResponseStream) Write(inputData []byte) (int, error) {
 		s.output <- dataFrame
 
 		written += common.MAX_DATA_SIZE
+		data = data[common.MAX_DATA_SIZE:]
 	}
 
 	n := len(data)
 	if n == 0 {
+		s.record.Sent(written)
 		return written, nil
 	}
 
@@ -117,6 +130,7 @@ func (s *ResponseStream) Write(inputData []byte) (int, error) {
 	dataFrame.Data = data
 	s.output <- dataFrame
 
+	s.record.Sent(written + n)
 	return written + n, nil
 }
 
@@ -132,8 +146,15 @@ func (s *ResponseStream) WriteHeader(code int) {
 		return
 	}
 
+	// Push any preloaded resources before the
+	// response that refers to them.
+	if code != 204 && code != 304 && code/100 != 1 {
+		s.pushPreloads()
+	}
+
 	s.wroteHeader = true
 	s.responseCode = code
+	s.record.WroteHeader(code)
 	s.header.Set("status", strconv.Itoa(code))
 	s.header.Set("version", "HTTP/1.1")
 
@@ -156,6 +177,26 @@ func (s *ResponseStream) WriteHeader(code int) {
 	s.output <- synReply
 }
 
+/****************
+ * http.Flusher *
+ ****************/
+
+// Flush sends any pending headers to the client
+// immediately.
+func (s *ResponseStream) Flush() {
+	if s.unidirectional || s.closed() || s.state.ClosedHere() {
+		return
+	}
+
+	// Default to 200 response.
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+
+	// Send any new headers.
+	s.writeHeader()
+}
+
 /*****************
  * io.Closer *
  *****************/
@@ -168,14 +209,19 @@ func (s *ResponseStream) Close() error {
 }
 
 func (s *ResponseStream) shutdown() {
+	s.conn.pushesDone(s)
+	s.record.Finish(common.StreamGoaway, 0)
 	s.writeHeader()
 	if s.state != nil {
 		s.state.Close()
 	}
 	if s.requestBody != nil {
-		s.requestBody.Reset()
-		s.requestBody = nil
+		s.requestBody.CloseWithError(common.ErrStreamClosed)
+	}
+	if s.cancel != nil {
+		s.cancel()
 	}
+	close(s.closeNotify)
 	s.output = nil
 	s.request = nil
 	s.handler = nil
@@ -202,24 +248,17 @@ func (s *ResponseStream) ReceiveFrame(frame common.Frame) error {
 	// Process the frame depending on its type.
 	switch frame := frame.(type) {
 	case *frames.DATA:
+		s.record.Received(len(frame.Data))
 		s.requestBody.Write(frame.Data)
 		if frame.Flags.FIN() {
-			select {
-			case <-s.ready:
-			default:
-				close(s.ready)
-			}
+			s.requestBody.CloseWithError(nil)
 			s.state.CloseThere()
 		}
 
 	case *frames.SYN_REPLY:
 		common.UpdateHeader(s.header, frame.Header)
 		if frame.Flags.FIN() {
-			select {
-			case <-s.ready:
-			default:
-				close(s.ready)
-			}
+			s.requestBody.CloseWithError(nil)
 			s.state.CloseThere()
 		}
 
@@ -236,8 +275,11 @@ func (s *ResponseStream) ReceiveFrame(frame common.Frame) error {
 	return nil
 }
 
+// CloseNotify returns a channel which is closed
+// if the stream is reset by the client or the
+// connection closes.
 func (s *ResponseStream) CloseNotify() <-chan bool {
-	return s.stop
+	return s.closeNotify
 }
 
 // run is the main control path of
@@ -249,34 +291,52 @@ func (s *ResponseStream) Run() error {
 	// Catch any panics.
 	defer func() {
 		if v := recover(); v != nil {
-			if s != nil && s.state != nil && !s.state.Closed() {
-				log.Println("Encountered stream error:", v)
-			}
+			s.handlerPanic(v)
 		}
 	}()
 
-	// Make sure Request is prepared.
-	if s.requestBody == nil || s.request.Body == nil {
-		s.requestBody = new(bytes.Buffer)
-		s.request.Body = &common.ReadCloser{s.requestBody}
+	// Make sure Request is prepared. The
+	// stream may have been closed already,
+	// such as if the connection has closed.
+	s.Lock()
+	handler, request := s.handler, s.request
+	if handler == nil {
+		s.Unlock()
+		return nil
 	}
-
-	// Wait until the full request has been received.
-	<-s.ready
+	if s.requestBody == nil || request.Body == nil {
+		s.requestBody = common.NewPipeWithBudget(s.conn.memory)
+		request.Body = s.requestBody
+	}
+	s.Unlock()
 
 	/***************
 	 *** HANDLER ***
 	 ***************/
-	s.handler.ServeHTTP(s, s.request)
+	handler.ServeHTTP(s, request)
+	s.pushes.Wait()
+
+	// Hijacked streams are closed by the
+	// handler, ending the request's context.
+	if s.hijacked {
+		return nil
+	}
+	s.cancel()
 
 	// Close the stream with a SYN_REPLY if
 	// none has been sent, or an empty DATA
 	// frame, if a SYN_REPLY has been sent
 	// already.
 	// If the stream is already closed at
-	// this end, then nothing happens.
-	if !s.unidirectional {
+	// this end, then nothing happens. The frame
+	// is prepared with the lock held, as the
+	// connection may be closing the stream.
+	var final common.Frame
+	s.Lock()
+	output := s.output
+	if !s.unidirectional && s.output != nil {
 		if s.state.OpenHere() && !s.wroteHeader {
+			s.record.WroteHeader(http.StatusOK)
 			s.header.Set("status", "200")
 			s.header.Set("version", "HTTP/1.1")
 
@@ -286,7 +346,7 @@ func (s *ResponseStream) Run() error {
 			synReply.StreamID = s.streamID
 			synReply.Header = s.header
 
-			s.output <- synReply
+			final = synReply
 		} else if s.state.OpenHere() {
 			// Create the DATA.
 			data := new(frames.DATA)
@@ -294,15 +354,111 @@ func (s *ResponseStream) Run() error {
 			data.Flags = common.FLAG_FIN
 			data.Data = []byte{}
 
-			s.output <- data
+			final = data
 		}
 	}
+	s.Unlock()
+	if final != nil {
+		output <- final
+	}
 
 	// Clean up state.
 	s.state.CloseHere()
+	s.record.Finish(common.StreamFinished, 0)
 	return nil
 }
 
+// handlerPanic is called when the handler panics. If
+// no response has been sent, the client is sent a 500
+// response. Otherwise, the stream is reset. Either way,
+// the connection continues to serve other streams.
+func (s *ResponseStream) handlerPanic(v interface{}) {
+	if s.closed() || s.state.Closed() {
+		return
+	}
+
+	common.ReportHandlerPanic(s.streamID, s.request, v)
+	s.cancel()
+
+	if !s.wroteHeader && !s.unidirectional && v != http.ErrAbortHandler {
+		s.wroteHeader = true
+		s.header = make(http.Header)
+
+		// Create the response SYN_REPLY.
+		synReply := new(frames.SYN_REPLY)
+		synReply.Flags = common.FLAG_FIN
+		synReply.StreamID = s.streamID
+		synReply.Header = make(http.Header)
+		synReply.Header.Set("status", strconv.Itoa(http.StatusInternalServerError))
+		synReply.Header.Set("version", "HTTP/1.1")
+
+		s.output <- synReply
+		s.record.WroteHeader(http.StatusInternalServerError)
+		s.record.Finish(common.StreamFinished, 0)
+		s.state.CloseHere()
+		return
+	}
+
+	// Discard any unsent headers.
+	s.header = make(http.Header)
+
+	rst := new(frames.RST_STREAM)
+	rst.StreamID = s.streamID
+	rst.Status = common.RST_STREAM_INTERNAL_ERROR
+	s.output <- rst
+	s.record.Finish(common.StreamReset, rst.Status)
+
+	s.Close()
+}
+
+// pushPreloads pushes the resources listed in the
+// response's Link headers with rel=preload, if
+// enabled. Each is served by the stream's handler,
+// as if it had been requested by the client.
+func (s *ResponseStream) pushPreloads() {
+	if !s.conn.config.PushPreloads || s.unidirectional || s.handler == nil {
+		return
+	}
+
+	for _, target := range common.PreloadLinks(s.header, s.request.URL) {
+		if !s.conn.preload(target) {
+			continue
+		}
+		request, err := common.PreloadRequest(s.request, target)
+		if err != nil {
+			s.conn.unpreload(target)
+			continue
+		}
+		push, err := s.conn.Push(target, s)
+		if err != nil {
+			debug.Printf("Failed to push %s: %v\n", target, err)
+			s.conn.unpreload(target)
+			continue
+		}
+
+		s.pushes.Add(1)
+		go s.servePush(s.handler, push, request.WithContext(push.Context()))
+	}
+}
+
+// servePush serves a preloaded resource on
+// the given push stream.
+func (s *ResponseStream) servePush(handler http.Handler, push common.PushStream, request *http.Request) {
+	defer s.pushes.Done()
+	defer func() {
+		if v := recover(); v != nil {
+			common.ReportHandlerPanic(push.StreamID(), request, v)
+			if !push.State().ClosedHere() {
+				s.conn._RST_STREAM(push.StreamID(), common.RST_STREAM_INTERNAL_ERROR)
+			}
+			push.Close()
+		}
+	}()
+
+	handler.ServeHTTP(push, request)
+	push.Finish()
+}
+
 func (s *ResponseStream) State() *common.StreamState {
 	return s.state
 }
@@ -349,3 +505,77 @@ func (s *ResponseStream) writeHeader() {
 func (s *ResponseStream) Priority() common.Priority {
 	return s.priority
 }
+
+func (s *ResponseStream) accessRecord() *common.StreamRecorder {
+	return s.record
+}
+
+/*******************
+ * StreamHijacker *
+ *******************/
+
+// HijackStream lets the handler take over the stream,
+// once the response headers have been sent. Reads
+// return data from the client as it arrives, and
+// writes are sent to the client as DATA frames.
+// Closing the returned stream half-closes the stream.
+//
+// Once the stream has been hijacked, the Request's Body
+// should not be used, and the stream is not closed when
+// the handler returns. The caller must close the returned
+// stream, which also ends the Request's context.
+func (s *ResponseStream) HijackStream() (io.ReadWriteCloser, error) {
+	if s.unidirectional {
+		return nil, errors.New("Error: Stream is unidirectional.")
+	}
+
+	if s.hijacked {
+		return nil, errors.New("Error: Stream already hijacked.")
+	}
+
+	// Send the response headers.
+	s.Flush()
+
+	if s.closed() || s.state.ClosedHere() {
+		return nil, errors.New("Error: Stream already closed.")
+	}
+
+	s.hijacked = true
+	return &hijackedStream{s}, nil
+}
+
+// hijackedStream is the io.ReadWriteCloser
+// returned by ResponseStream.HijackStream.
+type hijackedStream struct {
+	stream *ResponseStream
+}
+
+func (h *hijackedStream) Read(b []byte) (int, error) {
+	return h.stream.requestBody.Read(b)
+}
+
+func (h *hijackedStream) Write(b []byte) (int, error) {
+	return h.stream.Write(b)
+}
+
+// Close half-closes the stream, sending
+// an empty DATA frame with FIN set, and
+// ends the request's context. Data sent
+// by the client can still be read.
+func (h *hijackedStream) Close() error {
+	s := h.stream
+	if s.closed() || s.state.ClosedHere() {
+		return nil
+	}
+	defer s.cancel()
+
+	data := new(frames.DATA)
+	data.StreamID = s.streamID
+	data.Flags = common.FLAG_FIN
+	data.Data = []byte{}
+	s.output <- data
+
+	s.state.CloseHere()
+	s.record.Finish(common.StreamFinished, 0)
+	return nil
+}
@@ -39,15 +39,7 @@ func (c *Conn) shutdown() {
 	c.goawayLock.Unlock()
 	if !sent && !isSending {
 		goaway := new(frames.GOAWAY)
-		if c.server != nil {
-			c.lastRequestStreamIDLock.Lock()
-			goaway.LastGoodStreamID = c.lastRequestStreamID
-			c.lastRequestStreamIDLock.Unlock()
-		} else {
-			c.lastPushStreamIDLock.Lock()
-			goaway.LastGoodStreamID = c.lastPushStreamID
-			c.lastPushStreamIDLock.Unlock()
-		}
+		goaway.LastGoodStreamID = c.lastGoodStreamID()
 		select {
 		case c.output[0] <- goaway:
 			c.goawayLock.Lock()
@@ -81,6 +73,11 @@ func (c *Conn) shutdown() {
 		close(c.stop)
 	}
 
+	// Cancel any outstanding requests.
+	if c.cancelContext != nil {
+		c.cancelContext()
+	}
+
 	c.connLock.Lock()
 	if c.conn != nil {
 		c.conn.Close()
@@ -101,9 +98,25 @@ func (c *Conn) shutdown() {
 		c.compressor.Close()
 		c.compressor = nil
 	}
-	c.decompressor = nil
+	// The decompressor is left in place, as
+	// readFrames may still be decompressing a
+	// frame read before the connection closed.
 
+	if c.abuse != nil {
+		c.abuse.Close()
+	}
+
+	c.pushedResourcesLock.Lock()
 	c.pushedResources = nil
+	c.pushedResourcesLock.Unlock()
+
+	// Inform any outstanding PINGs that they failed.
+	c.pingsLock.Lock()
+	for pid, ping := range c.pings {
+		close(ping)
+		delete(c.pings, pid)
+	}
+	c.pingsLock.Unlock()
 
 	for _, stream := range c.output {
 		select {
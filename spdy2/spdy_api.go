@@ -4,6 +4,7 @@ import (
 	"errors"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/SlyMarbo/spdy/common"
@@ -41,8 +42,21 @@ func (c *Conn) Ping() (<-chan bool, error) {
 }
 
 // Push is used to issue a server push to the client. Note that this cannot be performed
-// by clients.
+// by clients. The push is sent at the lowest priority.
 func (c *Conn) Push(resource string, origin common.Stream) (common.PushStream, error) {
+	return c.PushWithOptions(resource, origin, &common.PushOptions{Priority: 7})
+}
+
+// PushWithOptions is like Push, but allows the pushed request's
+// method, and the response's status, initial headers and
+// priority to be given. Options may be nil, in which case the
+// push is sent at the same priority as origin.
+func (c *Conn) PushWithOptions(resource string, origin common.Stream, options *common.PushOptions) (common.PushStream, error) {
+	options, err := options.Prepare()
+	if err != nil {
+		return nil, err
+	}
+
 	c.goawayLock.Lock()
 	goaway := c.goawayReceived || c.goawaySent
 	c.goawayLock.Unlock()
@@ -65,6 +79,11 @@ func (c *Conn) Push(resource string, origin common.Stream) (common.PushStream, e
 	resource = url.String()
 
 	// Ensure the resource hasn't been pushed on the given stream already.
+	c.pushedResourcesLock.Lock()
+	if c.pushedResources == nil {
+		c.pushedResourcesLock.Unlock()
+		return nil, common.ErrGoaway
+	}
 	if c.pushedResources[origin] == nil {
 		c.pushedResources[origin] = map[string]struct{}{
 			resource: struct{}{},
@@ -72,31 +91,53 @@ func (c *Conn) Push(resource string, origin common.Stream) (common.PushStream, e
 	} else if _, ok := c.pushedResources[origin][url.String()]; !ok {
 		c.pushedResources[origin][resource] = struct{}{}
 	} else {
+		c.pushedResourcesLock.Unlock()
 		return nil, errors.New("Error: Resource already pushed to this stream.")
 	}
+	c.pushedResourcesLock.Unlock()
 
 	// Check stream limit would allow the new stream.
 	if !c.pushStreamLimit.Add() {
 		return nil, errors.New("Error: Max concurrent streams limit exceeded.")
 	}
 
+	// Check the push budget.
+	if err := c.pushAccount.Start(origin.StreamID()); err != nil {
+		c.pushStreamLimit.Close()
+		c.pushedResourcesLock.Lock()
+		delete(c.pushedResources[origin], resource)
+		c.pushedResourcesLock.Unlock()
+		return nil, err
+	}
+
 	// Verify that path is prefixed with / as required by spec.
 	path := url.Path
 	if !strings.HasPrefix(path, "/") {
 		path = "/" + path
 	}
 
-	// Prepare the SYN_STREAM.
+	// Pushes are sent relative to the
+	// priority of the associated stream.
+	priority := common.Priority(0)
+	if stream, ok := origin.(common.PriorityStream); ok {
+		priority = stream.Priority()
+	}
+
+	// Prepare the SYN_STREAM. Only the special request
+	// headers are sent, with the initial response
+	// headers.
 	push := new(frames.SYN_STREAM)
 	push.Flags = common.FLAG_UNIDIRECTIONAL
 	push.AssocStreamID = origin.StreamID()
-	push.Priority = 3
+	push.Priority = options.PushPriority(priority, 3)
 	push.Header = make(http.Header)
+	common.UpdateHeader(push.Header, options.ResponseHeader)
+	push.Header.Set("method", options.Method)
 	push.Header.Set("scheme", url.Scheme)
 	push.Header.Set("host", url.Host)
 	push.Header.Set("url", path)
 	push.Header.Set("version", "HTTP/1.1")
-	push.Header.Set(":status", "200 OK")
+	push.Header.Set("status", strings.TrimSpace(strconv.Itoa(options.Status)+" "+http.StatusText(options.Status)))
 
 	// Send.
 	c.streamCreation.Lock()
@@ -107,13 +148,30 @@ func (c *Conn) Push(resource string, origin common.Stream) (common.PushStream, e
 	newID := c.lastPushStreamID
 	c.lastPushStreamIDLock.Unlock()
 	if newID > common.MAX_STREAM_ID {
+		c.pushStreamLimit.Close()
+		c.pushAccount.Cancel(origin.StreamID())
+		c.pushedResourcesLock.Lock()
+		delete(c.pushedResources[origin], resource)
+		c.pushedResourcesLock.Unlock()
 		return nil, errors.New("Error: All server streams exhausted.")
 	}
 	push.StreamID = newID
 	c.output[0] <- push
 
 	// Create the PushStream.
-	out := NewPushStream(c, newID, origin, c.output[3])
+	out := NewPushStream(c, newID, origin, c.output[push.Priority])
+	request := &http.Request{
+		Method:     options.Method,
+		URL:        url,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       url.Host,
+		RequestURI: url.RequestURI(),
+	}
+	out.record = common.NewStreamRecorder(c.config.AccessLogger, c.id, newID, c.version(), push.Priority, request, true)
+	out.record.WroteHeader(options.Status)
 
 	// Store in the connection map.
 	c.streamsLock.Lock()
@@ -122,3 +180,34 @@ func (c *Conn) Push(resource string, origin common.Stream) (common.PushStream, e
 
 	return out, nil
 }
+
+// pushesDone releases the state of the pushes sent
+// for the given stream, once it has finished.
+func (c *Conn) pushesDone(origin common.Stream) {
+	c.pushedResourcesLock.Lock()
+	delete(c.pushedResources, origin)
+	c.pushedResourcesLock.Unlock()
+	c.pushAccount.Finish(origin.StreamID())
+}
+
+// preload records that the given resource is being
+// pushed from a Link header, returning false if it
+// has been pushed on this connection already.
+func (c *Conn) preload(resource string) bool {
+	c.preloadedLock.Lock()
+	defer c.preloadedLock.Unlock()
+	if _, ok := c.preloaded[resource]; ok {
+		return false
+	}
+	c.preloaded[resource] = struct{}{}
+	return true
+}
+
+// unpreload forgets that the given resource has
+// been pushed from a Link header, such as once
+// the push has failed, so it can be retried.
+func (c *Conn) unpreload(resource string) {
+	c.preloadedLock.Lock()
+	delete(c.preloaded, resource)
+	c.preloadedLock.Unlock()
+}
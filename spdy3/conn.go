@@ -6,6 +6,7 @@ package spdy3
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"net"
@@ -26,21 +27,33 @@ type Conn struct {
 	Subversion   int             // SPDY 3 subversion (eg 0 for SPDY/3, 1 for SPDY/3.1).
 
 	// SPDY/3.1
-	dataBuffer                []*frames.DATA // used to store frames witheld for flow control.
-	connectionWindowSize      int64
+	session                   *sessionQueue // used to store frames witheld for flow control.
+	connectionWindowGrown     chan struct{} // used to retry witheld frames.
 	initialWindowSizeThere    uint32
 	connectionWindowSizeThere int64
+	connectionWindowLock      sync.Mutex // protects connectionWindowSizeThere and awaitingRelief.
+	awaitingRelief            bool       // the session window will be regrown once memory allows.
 
 	// network state
-	remoteAddr  string
-	server      *http.Server                      // nil if client connection.
-	conn        net.Conn                          // underlying network (TLS) connection.
-	connLock    sync.Mutex                        // protects the interface value of the above conn.
-	buf         *bufio.Reader                     // buffered reader on conn.
-	tlsState    *tls.ConnectionState              // underlying TLS connection state.
-	streams     map[common.StreamID]common.Stream // map of active streams.
-	streamsLock sync.Mutex                        // protects streams.
-	output      [8]chan common.Frame              // one output channel per priority level.
+	remoteAddr    string
+	id            uint64                            // identifies the connection in access logs.
+	server        *http.Server                      // nil if client connection.
+	config        *common.Config                    // settings for the connection.
+	conn          net.Conn                          // underlying network (TLS) connection.
+	connLock      sync.Mutex                        // protects the interface value of the above conn.
+	buf           *bufio.Reader                     // buffered reader on conn.
+	tlsState      *tls.ConnectionState              // underlying TLS connection state.
+	hostCert      *x509.Certificate                 // certificate negotiated with SNI, used to check :host.
+	streams       map[common.StreamID]common.Stream // map of active streams.
+	streamsLock   sync.Mutex                        // protects streams.
+	output        [8]chan common.Frame              // one output channel per priority level.
+	controlOutput chan common.Frame                 // output channel for control frames, sent first.
+
+	// outbound queue
+	scheduler     common.Scheduler                    // orders queued stream frames.
+	schedulerLock sync.Mutex                          // protects scheduler, control and priorities.
+	control       []common.Frame                      // queued control frames, sent first.
+	priorities    map[common.StreamID]common.Priority // streams whose priority has changed.
 
 	// other state
 	compressor       common.Compressor              // outbound compression state.
@@ -50,24 +63,35 @@ type Conn struct {
 	goawaySent       bool                           // goaway has been sent.
 	goawayLock       sync.Mutex                     // protects goawaySent and goawayReceived.
 	numBenignErrors  int                            // number of non-serious errors encountered.
+	headerLimits     common.HeaderLimits            // limits on inbound header blocks.
+	numHeaderErrors  int                            // number of header blocks over the limits.
+	abuse            *common.AbuseTracker           // rate limits on the other endpoint.
 	readTimeout      time.Duration                  // optional timeout for network reads.
 	writeTimeout     time.Duration                  // optional timeout for network writes.
 	timeoutLock      sync.Mutex                     // protects changes to readTimeout and writeTimeout.
 	vectorIndex      uint16                         // current limit on the credential vector size.
 	certificates     map[uint16][]*x509.Certificate // certificates from CREDENTIALs and TLS handshake.
 	flowControl      common.FlowControl             // flow control module.
-	flowControlLock  sync.Mutex                     // protects flowControl.
+	flowControlLock  sync.Mutex                     // protects flowControl and rttObservers.
+	memory           *common.MemoryBudget           // accounts for buffered stream data.
 
 	// SPDY features
-	pings                map[uint32]chan<- bool                // response channel for pings.
-	pingsLock            sync.Mutex                            // protects pings.
-	nextPingID           uint32                                // next outbound ping ID.
-	nextPingIDLock       sync.Mutex                            // protects nextPingID.
-	pushStreamLimit      *common.StreamLimit                   // Limit on streams started by the server.
-	pushRequests         map[common.StreamID]*http.Request     // map of requests sent in server pushes.
-	lastPushStreamID     common.StreamID                       // last push stream ID. (even)
-	lastPushStreamIDLock sync.Mutex                            // protects lastPushStreamID.
-	pushedResources      map[common.Stream]map[string]struct{} // prevents duplicate headers being pushed.
+	pings                map[uint32]chan<- bool                 // response channel for pings.
+	pingsLock            sync.Mutex                             // protects pings, pingTimes and lastRTTSample.
+	pingTimes            map[uint32]time.Time                   // send times of pings, for measuring RTT.
+	rttObservers         map[common.StreamID]common.RTTObserver // streams' flow control using RTT.
+	lastRTTSample        time.Time                              // when a PING was last sent to measure RTT.
+	nextPingID           uint32                                 // next outbound ping ID.
+	nextPingIDLock       sync.Mutex                             // protects nextPingID.
+	pushStreamLimit      *common.StreamLimit                    // Limit on streams started by the server.
+	pushes               map[common.StreamID]*receivedPush      // pushes received from the server.
+	lastPushStreamID     common.StreamID                        // last push stream ID. (even)
+	lastPushStreamIDLock sync.Mutex                             // protects lastPushStreamID.
+	pushedResources      map[common.Stream]map[string]struct{}  // prevents duplicate headers being pushed.
+	pushedResourcesLock  sync.Mutex                             // protects pushedResources.
+	pushAccount          *common.PushAccount                    // limits on pushes sent.
+	preloaded            map[string]struct{}                    // resources pushed from Link headers.
+	preloadedLock        sync.Mutex                             // protects preloaded.
 
 	// requests
 	lastRequestStreamID     common.StreamID     // last request stream ID. (odd)
@@ -84,15 +108,26 @@ type Conn struct {
 	sendingLock  sync.Mutex    // protects changes to sending's value.
 	init         func()        // this function is called before the connection begins.
 	shutdownOnce sync.Once     // used to ensure clean shutdown.
+
+	// request contexts
+	baseContext   context.Context    // parent of each request's context.
+	cancelContext context.CancelFunc // cancels baseContext when the connection closes.
 }
 
-// NewConn produces an initialised spdy3 connection.
-func NewConn(conn net.Conn, server *http.Server, subversion int) *Conn {
+// NewConn produces an initialised spdy3 connection. If
+// config is nil, the defaults from common.DefaultConfig
+// are used.
+func NewConn(conn net.Conn, server *http.Server, subversion int, config *common.Config) *Conn {
 	out := new(Conn)
 
 	// Common ground.
+	out.id = common.NextConnID()
 	out.remoteAddr = conn.RemoteAddr().String()
 	out.server = server
+	out.config = config
+	if config == nil {
+		out.config = common.DefaultConfig()
+	}
 	out.conn = conn
 	out.buf = bufio.NewReader(conn)
 	if tlsConn, ok := conn.(*tls.Conn); ok {
@@ -108,17 +143,40 @@ func NewConn(conn net.Conn, server *http.Server, subversion int) *Conn {
 	out.output[5] = make(chan common.Frame)
 	out.output[6] = make(chan common.Frame)
 	out.output[7] = make(chan common.Frame)
+	out.controlOutput = make(chan common.Frame)
 	out.pings = make(map[uint32]chan<- bool)
+	out.pingTimes = make(map[uint32]time.Time)
+	out.rttObservers = make(map[common.StreamID]common.RTTObserver)
 	out.compressor = common.NewCompressor(3)
-	out.decompressor = common.NewDecompressor(3)
+	out.headerLimits = common.DefaultHeaderLimits
+	if server != nil && server.MaxHeaderBytes > 0 {
+		out.headerLimits.MaxBytes = server.MaxHeaderBytes
+	}
+	out.decompressor = common.NewDecompressorWithLimits(3, out.headerLimits)
+	if policy := out.config.AbusePolicy; policy != nil {
+		out.abuse = policy.Track(conn.RemoteAddr())
+	}
 	out.receivedSettings = make(common.Settings)
 	out.lastPushStreamID = 0
 	out.lastRequestStreamID = 0
 	out.stop = make(chan bool)
+	out.baseContext, out.cancelContext = context.WithCancel(context.Background())
 	out.Subversion = subversion
+	out.memory = out.config.MemoryBudget
+	if out.memory == nil {
+		out.memory = common.DefaultMemoryBudget
+	}
+	if scheduler := out.config.Scheduler; scheduler != nil {
+		out.scheduler = scheduler()
+	} else {
+		out.scheduler = common.DefaultScheduler()
+	}
+	out.priorities = make(map[common.StreamID]common.Priority)
 
 	// Server/client specific.
 	if server != nil { // servers
+		out.baseContext = context.WithValue(out.baseContext, http.ServerContextKey, server)
+		out.baseContext = context.WithValue(out.baseContext, http.LocalAddrContextKey, conn.LocalAddr())
 		out.nextPingID = 2
 		out.oddity = 0
 		out.initialWindowSize = common.DEFAULT_INITIAL_WINDOW_SIZE
@@ -129,7 +187,7 @@ func NewConn(conn net.Conn, server *http.Server, subversion int) *Conn {
 			// Initialise the connection by sending the connection settings.
 			settings := new(frames.SETTINGS)
 			settings.Settings = defaultServerSettings(common.DEFAULT_STREAM_LIMIT)
-			out.output[0] <- settings
+			out.controlOutput <- settings
 		}
 		if d := server.ReadTimeout; d != 0 {
 			out.SetReadTimeout(d)
@@ -139,39 +197,54 @@ func NewConn(conn net.Conn, server *http.Server, subversion int) *Conn {
 		}
 		out.flowControl = DefaultFlowControl(common.DEFAULT_INITIAL_WINDOW_SIZE)
 		out.pushedResources = make(map[common.Stream]map[string]struct{})
+		out.pushAccount = common.NewPushAccount(out.config.PushBudget)
+		out.preloaded = make(map[string]struct{})
+
+		// Virtual hosts are checked against the
+		// certificate chosen for the connection.
+		if _, ok := server.Handler.(common.HostRouter); ok && out.tlsState != nil {
+			out.hostCert = common.NegotiatedCertificate(server.TLSConfig, out.tlsState.ServerName)
+		}
 
 		if subversion == 0 {
 			out.certificates = make(map[uint16][]*x509.Certificate, 8)
 			if out.tlsState != nil && out.tlsState.PeerCertificates != nil {
 				out.certificates[1] = out.tlsState.PeerCertificates
 			}
-		} else if subversion == 1 {
-			out.connectionWindowSize = common.DEFAULT_INITIAL_WINDOW_SIZE
 		}
 
 	} else { // clients
 		out.nextPingID = 1
 		out.oddity = 1
-		out.initialWindowSize = common.DEFAULT_INITIAL_CLIENT_WINDOW_SIZE
+		out.initialWindowSize = common.DEFAULT_INITIAL_WINDOW_SIZE
 		out.requestStreamLimit = common.NewStreamLimit(common.NO_STREAM_LIMIT)
 		out.pushStreamLimit = common.NewStreamLimit(common.DEFAULT_STREAM_LIMIT)
-		out.pushRequests = make(map[common.StreamID]*http.Request)
+		out.pushes = make(map[common.StreamID]*receivedPush)
 		out.init = func() {
 			// Initialise the connection by sending the connection settings.
 			settings := new(frames.SETTINGS)
 			settings.Settings = defaultClientSettings(common.DEFAULT_STREAM_LIMIT)
-			out.output[0] <- settings
+			out.controlOutput <- settings
 		}
 		out.flowControl = DefaultFlowControl(common.DEFAULT_INITIAL_CLIENT_WINDOW_SIZE)
-
-		if subversion == 1 {
-			out.connectionWindowSize = common.DEFAULT_INITIAL_CLIENT_WINDOW_SIZE
-		}
 	}
 
 	if subversion == 1 {
+		out.session = newSessionQueue(common.DEFAULT_INITIAL_WINDOW_SIZE, out.memory)
+		out.connectionWindowGrown = make(chan struct{}, 1)
 		out.initialWindowSizeThere = out.flowControl.InitialWindowSize()
-		out.connectionWindowSizeThere = int64(out.initialWindowSizeThere)
+		out.connectionWindowSizeThere = common.DEFAULT_INITIAL_WINDOW_SIZE
+
+		// The session window always starts at the default
+		// size, so it is grown at once if the flow control
+		// uses a larger window.
+		init := out.init
+		out.init = func() {
+			init()
+			out.connectionWindowLock.Lock()
+			out.regrowSessionWindow()
+			out.connectionWindowLock.Unlock()
+		}
 	}
 	return out
 }
@@ -179,13 +252,13 @@ func NewConn(conn net.Conn, server *http.Server, subversion int) *Conn {
 // NextProto is intended for use in http.Server.TLSNextProto,
 // using SPDY/3 for the connection.
 func NextProto(s *http.Server, tlsConn *tls.Conn, handler http.Handler) {
-	NewConn(tlsConn, s, 0).Run()
+	NewConn(tlsConn, s, 0, nil).Run()
 }
 
 // NextProto1 is intended for use in http.Server.TLSNextProto,
 // using SPDY/3.1 for the connection.
 func NextProto1(s *http.Server, tlsConn *tls.Conn, handler http.Handler) {
-	NewConn(tlsConn, s, 1).Run()
+	NewConn(tlsConn, s, 1, nil).Run()
 }
 
 func (c *Conn) Run() error {
@@ -201,12 +274,27 @@ func (c *Conn) Run() error {
 // newStream is used to create a new serverStream from a SYN_STREAM frame.
 func (c *Conn) newStream(frame *frames.SYN_STREAM) *ResponseStream {
 	header := frame.Header
+	method := header.Get(":method")
 	rawUrl := header.Get(":scheme") + "://" + header.Get(":host") + header.Get(":path")
 
+	// CONNECT requests give only the
+	// host and port to connect to.
+	if method == "CONNECT" {
+		rawUrl = "//" + header.Get(":path")
+	}
+
 	url, err := url.Parse(rawUrl)
 	if c.check(err != nil, "Received SYN_STREAM with invalid request URL (%v)", err) {
 		return nil
 	}
+	requestURI := url.RequestURI()
+	if method == "CONNECT" {
+		_, _, err = net.SplitHostPort(url.Host)
+		if c.check(err != nil, "Received CONNECT with invalid address (%v)", err) {
+			return nil
+		}
+		requestURI = url.Host
+	}
 
 	vers := header.Get(":version")
 	major, minor, ok := http.ParseHTTPVersion(vers)
@@ -214,8 +302,6 @@ func (c *Conn) newStream(frame *frames.SYN_STREAM) *ResponseStream {
 		return nil
 	}
 
-	method := header.Get(":method")
-
 	// Build this into a request to present to the Handler.
 	request := &http.Request{
 		Method:     method,
@@ -226,13 +312,20 @@ func (c *Conn) newStream(frame *frames.SYN_STREAM) *ResponseStream {
 		RemoteAddr: c.remoteAddr,
 		Header:     header,
 		Host:       url.Host,
-		RequestURI: url.RequestURI(),
+		RequestURI: requestURI,
 		TLS:        c.tlsState,
 	}
 
+	handler := c.hostHandler(url.Host)
+	if handler == nil {
+		log.Printf("Warning: Refused stream %d for host %q from %s.\n", frame.StreamID, url.Host, c.remoteAddr)
+		c._RST_STREAM(frame.StreamID, common.RST_STREAM_REFUSED_STREAM)
+		return nil
+	}
+
 	output := c.output[frame.Priority]
 	c.streamCreation.Lock()
-	out := NewResponseStream(c, frame, output, c.server.Handler, request)
+	out := NewResponseStream(c, frame, output, handler, request)
 	c.streamCreation.Unlock()
 	c.flowControlLock.Lock()
 	f := c.flowControl
@@ -241,3 +334,20 @@ func (c *Conn) newStream(frame *frames.SYN_STREAM) *ResponseStream {
 
 	return out
 }
+
+// hostHandler returns the Handler for streams to the
+// given host, or nil if the stream should be refused.
+// If the server's Handler is a common.HostRouter, the
+// host must be covered by the connection's certificate.
+// Over TLS, streams are refused if the certificate is
+// not known.
+func (c *Conn) hostHandler(host string) http.Handler {
+	router, ok := c.server.Handler.(common.HostRouter)
+	if !ok {
+		return c.server.Handler
+	}
+	if c.tlsState != nil && (c.hostCert == nil || !common.CoversHost(c.hostCert, host)) {
+		return nil
+	}
+	return router.HostHandler(host)
+}
@@ -3,6 +3,8 @@ package spdy3
 import (
 	"io"
 	"net"
+	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/SlyMarbo/spdy/common"
@@ -35,16 +37,141 @@ func (c *Conn) _RST_STREAM(streamID common.StreamID, status common.StatusCode) {
 	rst := new(frames.RST_STREAM)
 	rst.StreamID = streamID
 	rst.Status = status
-	c.output[0] <- rst
+	c.controlOutput <- rst
+	c.recordReset(streamID, status)
 }
 
 func (c *Conn) _GOAWAY(status common.StatusCode) {
 	goaway := new(frames.GOAWAY)
 	goaway.Status = status
-	c.output[0] <- goaway
+	goaway.LastGoodStreamID = c.lastGoodStreamID()
+	c.controlOutput <- goaway
+	c.goawayLock.Lock()
+	c.goawaySent = true
+	c.goawayLock.Unlock()
 	c.Close()
 }
 
+// abusive records an event from the other endpoint,
+// ending the connection if it exceeds the abuse policy.
+// The returned boolean indicates whether the connection
+// is closing.
+func (c *Conn) abusive(event common.AbuseEvent) bool {
+	if c.abuse == nil || c.abuse.Allow(event) {
+		return false
+	}
+	log.Printf("Warning: Too many %s frames received from %s. Ending connection.\n", event, c.remoteAddr)
+	c.abuse.Violation()
+	c._GOAWAY(common.GOAWAY_PROTOCOL_ERROR)
+	return true
+}
+
+// version returns the SPDY version, for
+// the access logs.
+func (c *Conn) version() float64 {
+	if c.Subversion == 1 {
+		return 3.1
+	}
+	return 3
+}
+
+// accessRecorded is implemented by streams
+// whose details are passed to the access logger.
+type accessRecorded interface {
+	accessRecord() *common.StreamRecorder
+}
+
+// recordReset records in the access logs that the
+// given stream has been reset.
+func (c *Conn) recordReset(sid common.StreamID, status common.StatusCode) {
+	c.streamsLock.Lock()
+	stream := c.streams[sid]
+	c.streamsLock.Unlock()
+	if stream, ok := stream.(accessRecorded); ok {
+		stream.accessRecord().Finish(common.StreamReset, status)
+	}
+}
+
+// lastGoodStreamID returns the ID of the last
+// stream opened by the other endpoint.
+func (c *Conn) lastGoodStreamID() common.StreamID {
+	if c.server != nil {
+		c.lastRequestStreamIDLock.Lock()
+		defer c.lastRequestStreamIDLock.Unlock()
+		return c.lastRequestStreamID
+	}
+	c.lastPushStreamIDLock.Lock()
+	defer c.lastPushStreamIDLock.Unlock()
+	return c.lastPushStreamID
+}
+
+// handleHeaderLimit responds to a header block that
+// exceeded the connection's HeaderLimits. Requests are
+// given a 431 response, and other streams are reset. If
+// the other endpoint persists, the connection is ended.
+// The returned boolean indicates whether the connection
+// is closing.
+func (c *Conn) handleHeaderLimit(frame common.Frame, err *common.HeaderLimitError) bool {
+	log.Printf("%v (%s)\n", err, frame.Name())
+
+	c.numHeaderErrors++
+	if max := c.headerLimits.MaxViolations; max > 0 && c.numHeaderErrors > max {
+		log.Println("Warning: Too many header blocks over the limits received. Ending connection.")
+		c._GOAWAY(common.GOAWAY_PROTOCOL_ERROR)
+		return true
+	}
+
+	switch frame := frame.(type) {
+	case *frames.SYN_STREAM, *frames.SYN_STREAMV3_1:
+		var sid common.StreamID
+		var flags common.Flags
+		switch frame := frame.(type) {
+		case *frames.SYN_STREAM:
+			sid, flags = frame.StreamID, frame.Flags
+		case *frames.SYN_STREAMV3_1:
+			sid, flags = frame.StreamID, frame.Flags
+		}
+		// Servers can respond to requests with a
+		// 431 (Request Header Fields Too Large).
+		if c.server != nil {
+			reply := new(frames.SYN_REPLY)
+			reply.Flags = common.FLAG_FIN
+			reply.StreamID = sid
+			reply.Header = make(http.Header)
+			reply.Header.Set(":status", strconv.Itoa(http.StatusRequestHeaderFieldsTooLarge))
+			reply.Header.Set(":version", "HTTP/1.1")
+			c.output[0] <- reply
+			if !flags.FIN() {
+				c._RST_STREAM(sid, common.RST_STREAM_CANCEL)
+			}
+		} else {
+			c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
+		}
+
+	case *frames.SYN_REPLY:
+		c.resetStream(frame.StreamID)
+
+	case *frames.HEADERS:
+		c.resetStream(frame.StreamID)
+	}
+
+	return false
+}
+
+// resetStream sends a RST_STREAM with CANCEL
+// for the given stream, and closes it.
+func (c *Conn) resetStream(sid common.StreamID) {
+	c._RST_STREAM(sid, common.RST_STREAM_CANCEL)
+
+	c.streamsLock.Lock()
+	stream := c.streams[sid]
+	c.streamsLock.Unlock()
+	if stream != nil {
+		stream.State().CloseThere()
+		go stream.Close()
+	}
+}
+
 // handleReadWriteError differentiates between normal and
 // unexpected errors when performing I/O with the network,
 // then shuts down the connection.
@@ -75,7 +202,7 @@ func (c *Conn) protocolError(streamID common.StreamID) {
 	reply.StreamID = streamID
 	reply.Status = common.RST_STREAM_PROTOCOL_ERROR
 	select {
-	case c.output[0] <- reply:
+	case c.controlOutput <- reply:
 	case <-time.After(100 * time.Millisecond):
 		debug.Println("Failed to send PROTOCOL_ERROR RST_STREAM.")
 	}
@@ -7,6 +7,7 @@ package spdy3
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/SlyMarbo/spdy/common"
 	"github.com/SlyMarbo/spdy/spdy3/frames"
@@ -26,6 +27,123 @@ func (f DefaultFlowControl) ReceiveData(_ common.StreamID, initialWindowSize uin
 	return 0
 }
 
+// rttSampleInterval is the minimum time between
+// PINGs sent to measure the round-trip time.
+const rttSampleInterval = 10 * time.Second
+
+// sampleRTT sends a PING to measure the round-trip
+// time if the connection's or a stream's flow control
+// uses it, and it has not been measured recently.
+func (c *Conn) sampleRTT() {
+	c.flowControlLock.Lock()
+	_, ok := c.flowControl.(common.RTTObserver)
+	ok = ok || len(c.rttObservers) > 0
+	c.flowControlLock.Unlock()
+	if !ok {
+		return
+	}
+
+	c.pingsLock.Lock()
+	due := time.Since(c.lastRTTSample) >= rttSampleInterval
+	if due {
+		c.lastRTTSample = time.Now()
+	}
+	c.pingsLock.Unlock()
+
+	if due {
+		c.Ping()
+	}
+}
+
+// observeRTT passes a round-trip time measurement
+// to the connection's and streams' flow control, if
+// they use it.
+func (c *Conn) observeRTT(rtt time.Duration) {
+	c.flowControlLock.Lock()
+	observers := make([]common.RTTObserver, 0, len(c.rttObservers)+1)
+	if observer, ok := c.flowControl.(common.RTTObserver); ok {
+		observers = append(observers, observer)
+	}
+	for _, observer := range c.rttObservers {
+		observers = append(observers, observer)
+	}
+	c.flowControlLock.Unlock()
+
+	for _, observer := range observers {
+		observer.ObserveRTT(rtt)
+	}
+}
+
+// watchRTT records the flow control used by the
+// given stream, so that it receives round-trip
+// time measurements if it uses them. A nil flow
+// control removes the stream.
+func (c *Conn) watchRTT(streamID common.StreamID, f common.FlowControl) {
+	c.flowControlLock.Lock()
+	if observer, ok := f.(common.RTTObserver); ok {
+		c.rttObservers[streamID] = observer
+	} else {
+		delete(c.rttObservers, streamID)
+	}
+	c.flowControlLock.Unlock()
+}
+
+// regrowSessionWindow sends a WINDOW_UPDATE for the
+// session in SPDY/3.1 if the flow control policy
+// allows. While memory is scarce, the window is left
+// to shrink, and is regrown once memory allows. The
+// connectionWindowLock must be held.
+func (c *Conn) regrowSessionWindow() {
+	if c.memory.Pressure() {
+		c.memory.Withheld()
+		c.awaitSessionRelief()
+		return
+	}
+
+	c.flowControlLock.Lock()
+	f := c.flowControl
+	c.flowControlLock.Unlock()
+	delta := f.ReceiveData(0, c.initialWindowSizeThere, c.connectionWindowSizeThere)
+	if delta != 0 {
+		grow := new(frames.WINDOW_UPDATE)
+		grow.StreamID = 0
+		grow.DeltaWindowSize = delta
+		select {
+		case c.controlOutput <- grow:
+		case <-c.stop:
+			return
+		}
+		c.connectionWindowSizeThere += int64(grow.DeltaWindowSize)
+	}
+}
+
+// awaitSessionRelief regrows the session window
+// once memory pressure has eased. The
+// connectionWindowLock must be held.
+func (c *Conn) awaitSessionRelief() {
+	if c.awaitingRelief {
+		return
+	}
+	c.awaitingRelief = true
+
+	relief := c.memory.Relieved()
+	go func() {
+		select {
+		case <-relief:
+		case <-c.stop:
+			return
+		}
+
+		c.connectionWindowLock.Lock()
+		defer c.connectionWindowLock.Unlock()
+
+		c.awaitingRelief = false
+		if !c.closed() {
+			c.regrowSessionWindow()
+		}
+	}()
+}
+
 // flowControl is used by Streams to ensure that
 // they abide by SPDY's flow control rules. For
 // versions of SPDY before 3, this has no effect.
@@ -39,9 +157,20 @@ type flowControl struct {
 	transferWindow      int64
 	sent                uint32
 	buffer              [][]byte
+	buffered            int // bytes in buffer.
+	maxBuffer           int // limit on buffered, or negative for no limit.
+	deadline            time.Time
+	grown               chan struct{} // signalled when the transfer window grows.
+	done                chan struct{} // closed when the stream closes.
+	doneOnce            sync.Once
 	constrained         bool
+	finish              bool // send FIN once the buffer is empty.
+	receiveLock         sync.Mutex
 	initialWindowThere  uint32
 	transferWindowThere int64
+	unconsumed          int64 // received, but not yet consumed.
+	consumeOnRead       bool  // regrow the window only as data is consumed.
+	awaitingRelief      bool  // the window will be regrown once memory allows.
 	flowControl         common.FlowControl
 }
 
@@ -63,6 +192,9 @@ func (s *PushStream) AddFlowControl(f common.FlowControl) {
 	s.flow.streamID = s.streamID
 	s.flow.output = s.output
 	s.flow.buffer = make([][]byte, 0, 10)
+	s.flow.maxBuffer = s.conn.config.MaxStreamBuffer
+	s.flow.grown = make(chan struct{}, 1)
+	s.flow.done = make(chan struct{})
 	s.flow.initialWindow = initialWindow
 	s.flow.transferWindow = int64(initialWindow)
 	s.flow.stream = s
@@ -89,6 +221,9 @@ func (s *RequestStream) AddFlowControl(f common.FlowControl) {
 	s.flow.streamID = s.streamID
 	s.flow.output = s.output
 	s.flow.buffer = make([][]byte, 0, 10)
+	s.flow.maxBuffer = s.conn.config.MaxStreamBuffer
+	s.flow.grown = make(chan struct{}, 1)
+	s.flow.done = make(chan struct{})
 	s.flow.initialWindow = initialWindow
 	s.flow.transferWindow = int64(initialWindow)
 	s.flow.stream = s
@@ -115,12 +250,55 @@ func (s *ResponseStream) AddFlowControl(f common.FlowControl) {
 	s.flow.streamID = s.streamID
 	s.flow.output = s.output
 	s.flow.buffer = make([][]byte, 0, 10)
+	s.flow.maxBuffer = s.conn.config.MaxStreamBuffer
+	s.flow.grown = make(chan struct{}, 1)
+	s.flow.done = make(chan struct{})
 	s.flow.initialWindow = initialWindow
 	s.flow.transferWindow = int64(initialWindow)
 	s.flow.stream = s
 	s.flow.flowControl = f
 	s.flow.initialWindowThere = f.InitialWindowSize()
 	s.flow.transferWindowThere = int64(s.flow.initialWindowThere)
+	s.flow.consumeOnRead = true
+}
+
+// SetFlowControl sets the flow control mechanism used
+// to regrow the Stream's receive window, in place of
+// the connection's. The Stream's initial window size
+// is unchanged.
+func (s *PushStream) SetFlowControl(f common.FlowControl) {
+	if s.flow != nil {
+		s.flow.setFlowControl(f)
+	}
+}
+
+// SetFlowControl sets the flow control mechanism used
+// to regrow the Stream's receive window, in place of
+// the connection's. The Stream's initial window size
+// is unchanged.
+func (s *RequestStream) SetFlowControl(f common.FlowControl) {
+	if s.flow != nil {
+		s.flow.setFlowControl(f)
+	}
+}
+
+// SetFlowControl sets the flow control mechanism used
+// to regrow the Stream's receive window, in place of
+// the connection's. The Stream's initial window size
+// is unchanged.
+func (s *ResponseStream) SetFlowControl(f common.FlowControl) {
+	if s.flow != nil {
+		s.flow.setFlowControl(f)
+	}
+}
+
+// setFlowControl replaces the flow control
+// mechanism used to regrow the receive window.
+func (f *flowControl) setFlowControl(fc common.FlowControl) {
+	f.receiveLock.Lock()
+	f.flowControl = fc
+	f.receiveLock.Unlock()
+	f.conn.watchRTT(f.streamID, fc)
 }
 
 // CheckInitialWindow is used to handle the race
@@ -154,8 +332,18 @@ func (f *flowControl) CheckInitialWindow() {
 
 // Close nils any references held by the flowControl.
 func (f *flowControl) Close() {
+	f.Lock()
+	f.conn.memory.Release(f.buffered)
+	f.buffered = 0
 	f.buffer = nil
+	f.receiveLock.Lock() // Consume may be called by readers.
 	f.stream = nil
+	f.receiveLock.Unlock()
+	f.Unlock()
+	f.conn.watchRTT(f.streamID, nil)
+	f.doneOnce.Do(func() {
+		close(f.done)
+	})
 }
 
 // Flush is used to send buffered data to
@@ -165,39 +353,76 @@ func (f *flowControl) Close() {
 // sent with a single flush.
 func (f *flowControl) Flush() {
 	f.CheckInitialWindow()
-	if !f.constrained || f.transferWindow == 0 {
+	if !f.constrained || f.transferWindow <= 0 {
 		return
 	}
 
 	out := make([]byte, 0, f.transferWindow)
 	left := f.transferWindow
-	for i := 0; i < len(f.buffer); i++ {
-		if l := int64(len(f.buffer[i])); l <= left {
-			out = append(out, f.buffer[i]...)
+	for len(f.buffer) > 0 && left > 0 {
+		if l := int64(len(f.buffer[0])); l <= left {
+			out = append(out, f.buffer[0]...)
 			left -= l
 			f.buffer = f.buffer[1:]
 		} else {
-			out = append(out, f.buffer[i][:left]...)
-			f.buffer[i] = f.buffer[i][left:]
+			out = append(out, f.buffer[0][:left]...)
+			f.buffer[0] = f.buffer[0][left:]
 			left = 0
 		}
-
-		if left == 0 {
-			break
-		}
 	}
 
 	f.transferWindow -= int64(len(out))
+	f.buffered -= len(out)
+	f.conn.memory.Release(len(out))
 
 	if f.transferWindow > 0 {
 		f.constrained = false
 		log.Printf("Stream %d is no longer constrained.\n", f.streamID)
 	}
 
+	// Empty DATA frames without FIN are invalid.
+	if len(out) == 0 {
+		return
+	}
+
 	dataFrame := new(frames.DATA)
 	dataFrame.StreamID = f.streamID
 	dataFrame.Data = out
 
+	// Half-close the stream if Finish
+	// has been called.
+	if f.finish && len(f.buffer) == 0 {
+		dataFrame.Flags = common.FLAG_FIN
+		f.finish = false
+		f.stream.State().CloseHere()
+	}
+
+	f.output <- dataFrame
+}
+
+// Finish is used to half-close the stream. If
+// data is still buffered, the FIN is sent with
+// the last of the data, once the transfer window
+// allows.
+func (f *flowControl) Finish() {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.stream == nil {
+		return
+	}
+
+	if len(f.buffer) > 0 {
+		f.finish = true
+		return
+	}
+
+	dataFrame := new(frames.DATA)
+	dataFrame.StreamID = f.streamID
+	dataFrame.Flags = common.FLAG_FIN
+	dataFrame.Data = []byte{}
+	f.stream.State().CloseHere()
+
 	f.output <- dataFrame
 }
 
@@ -214,29 +439,107 @@ func (f *flowControl) Paused() bool {
 // the other endpoint. This ensures that they
 // conform to the transfer window, regrows the
 // window, and sends errors if necessary.
-func (f *flowControl) Receive(data []byte) {
-	// The transfer window shouldn't already be negative.
-	if f.transferWindowThere < 0 {
+//
+// If the stream's data is consumed by a reader,
+// the window is instead regrown by Consume.
+func (f *flowControl) Receive(data []byte) error {
+	f.receiveLock.Lock()
+	defer f.receiveLock.Unlock()
+
+	// The data must fit in the transfer window.
+	if int64(len(data)) > f.transferWindowThere {
 		rst := new(frames.RST_STREAM)
 		rst.StreamID = f.streamID
 		rst.Status = common.RST_STREAM_FLOW_CONTROL_ERROR
-		f.output <- rst
+		f.conn.controlOutput <- rst
+		return errors.New("Error: Received data exceeding the transfer window.")
 	}
 
 	// Update the window.
 	f.transferWindowThere -= int64(len(data))
 
-	// Regrow the window if it's half-empty.
-	delta := f.flowControl.ReceiveData(f.streamID, f.initialWindowThere, f.transferWindowThere)
+	if f.consumeOnRead {
+		f.unconsumed += int64(len(data))
+		return nil
+	}
+
+	f.regrowWindow()
+	return nil
+}
+
+// Consume is called when received data has been
+// read, regrowing the transfer window so that the
+// other endpoint can only send as much data as the
+// reader can handle.
+func (f *flowControl) Consume(n int) {
+	f.receiveLock.Lock()
+	defer f.receiveLock.Unlock()
+
+	if f.stream == nil || f.conn.closed() {
+		return
+	}
+
+	f.unconsumed -= int64(n)
+	f.regrowWindow()
+}
+
+// regrowWindow sends a WINDOW_UPDATE if the flow
+// control policy allows. Data not yet consumed is
+// treated as still occupying the window.
+//
+// While memory is scarce, the window is left to
+// shrink, and is regrown once memory allows.
+func (f *flowControl) regrowWindow() {
+	if f.conn.memory.Pressure() {
+		f.conn.memory.Withheld()
+		f.awaitRelief()
+		return
+	}
+
+	delta := f.flowControl.ReceiveData(f.streamID, f.initialWindowThere, f.transferWindowThere+f.unconsumed)
 	if delta != 0 {
 		grow := new(frames.WINDOW_UPDATE)
 		grow.StreamID = f.streamID
 		grow.DeltaWindowSize = delta
-		f.output <- grow
+		select {
+		case f.conn.controlOutput <- grow:
+		case <-f.conn.stop:
+			return
+		}
 		f.transferWindowThere += int64(grow.DeltaWindowSize)
 	}
 }
 
+// awaitRelief regrows the window once memory
+// pressure has eased. The receiveLock must be
+// held.
+func (f *flowControl) awaitRelief() {
+	if f.awaitingRelief {
+		return
+	}
+	f.awaitingRelief = true
+
+	relief := f.conn.memory.Relieved()
+	go func() {
+		select {
+		case <-relief:
+		case <-f.done:
+			return
+		case <-f.conn.stop:
+			return
+		}
+
+		f.receiveLock.Lock()
+		defer f.receiveLock.Unlock()
+
+		f.awaitingRelief = false
+		if f.stream == nil || f.conn.closed() {
+			return
+		}
+		f.regrowWindow()
+	}()
+}
+
 // UpdateWindow is called when an UPDATE_WINDOW frame is received,
 // and performs the growing of the transfer window.
 func (f *flowControl) UpdateWindow(deltaWindowSize uint32) error {
@@ -252,54 +555,153 @@ func (f *flowControl) UpdateWindow(deltaWindowSize uint32) error {
 	f.transferWindow += int64(deltaWindowSize)
 
 	f.Flush()
+
+	// Wake any blocked writer.
+	select {
+	case f.grown <- struct{}{}:
+	default:
+	}
 	return nil
 }
 
-// Write is used to send data to the connection. This
-// takes care of the windowing. Although data may be
-// buffered, rather than actually sent, this is not
-// visible to the caller.
-func (f *flowControl) Write(data []byte) (int, error) {
-	l := len(data)
-	if l == 0 {
-		return 0, nil
+// SetWriteDeadline sets the time after which
+// blocked writes fail with common.ErrTimeout.
+// A zero time means writes do not time out.
+func (f *flowControl) SetWriteDeadline(t time.Time) {
+	f.Lock()
+	f.deadline = t
+	f.Unlock()
+
+	// Wake any blocked writer to
+	// apply the new deadline.
+	select {
+	case f.grown <- struct{}{}:
+	default:
 	}
+}
 
-	if f.buffer == nil || f.stream == nil {
-		return 0, errors.New("Error: Stream closed.")
+// wait releases the lock until the transfer
+// window grows, the stream closes, or the
+// write deadline passes. The lock must be
+// held.
+func (f *flowControl) wait() error {
+	deadline := f.deadline
+	f.Unlock()
+	defer f.Lock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return common.ErrTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
 	}
 
-	// Transfer window processing.
-	f.CheckInitialWindow()
-	if f.constrained {
-		f.Flush()
+	select {
+	case <-f.grown:
+		return nil
+	case <-f.done:
+		return common.ErrStreamClosed
+	case <-f.conn.stop:
+		return common.ErrStreamClosed
+	case <-timeout:
+		return common.ErrTimeout
 	}
+}
+
+// Drain waits until any buffered data has
+// been sent, the stream closes, or the write
+// deadline passes.
+func (f *flowControl) Drain() error {
 	f.Lock()
-	var window uint32
-	if f.transferWindow < 0 {
-		window = 0
-	} else {
-		window = uint32(f.transferWindow)
-	}
-	f.Unlock()
+	defer f.Unlock()
 
-	if uint32(len(data)) > window {
-		f.buffer = append(f.buffer, data[window:])
-		data = data[:window]
-		f.sent += window
-		f.transferWindow -= int64(window)
-		f.constrained = true
-		log.Printf("Stream %d is now constrained.\n", f.streamID)
+	for {
+		f.CheckInitialWindow()
+		f.Flush()
+		if len(f.buffer) == 0 {
+			return nil
+		}
+		if f.stream == nil {
+			return common.ErrStreamClosed
+		}
+		if err := f.wait(); err != nil {
+			return err
+		}
 	}
+}
 
-	if len(data) == 0 {
-		return l, nil
+// Write is used to send data to the connection. This
+// takes care of the windowing. Data which does not fit
+// in the transfer window is buffered, up to the stream's
+// buffer limit and the memory budget. Once the buffer is full, Write blocks
+// until the window grows, the stream closes, or the
+// write deadline passes.
+func (f *flowControl) Write(data []byte) (int, error) {
+	l := len(data)
+	if l == 0 {
+		return 0, nil
 	}
 
-	dataFrame := new(frames.DATA)
-	dataFrame.StreamID = f.streamID
-	dataFrame.Data = data
+	f.Lock()
+	defer f.Unlock()
 
-	f.output <- dataFrame
-	return l, nil
+	written := 0
+	for {
+		if f.buffer == nil || f.stream == nil {
+			return written, common.ErrStreamClosed
+		}
+		if !f.deadline.IsZero() && !time.Now().Before(f.deadline) {
+			return written, common.ErrTimeout
+		}
+
+		// Transfer window processing.
+		f.CheckInitialWindow()
+		if f.constrained {
+			f.Flush()
+		}
+
+		// Send as much as the window allows, once
+		// any buffered data has been sent.
+		if len(f.buffer) == 0 && f.transferWindow > 0 {
+			n := len(data)
+			if int64(n) > f.transferWindow {
+				n = int(f.transferWindow)
+			}
+
+			f.sent += uint32(n)
+			f.transferWindow -= int64(n)
+
+			dataFrame := new(frames.DATA)
+			dataFrame.StreamID = f.streamID
+			dataFrame.Data = data[:n]
+
+			f.output <- dataFrame
+			written += n
+			data = data[n:]
+		}
+
+		if len(data) == 0 {
+			return l, nil
+		}
+
+		// Buffer the rest, if there is room.
+		room := f.maxBuffer < 0 || f.buffered+len(data) <= f.maxBuffer
+		if room && f.conn.memory.Reserve(len(data)) {
+			f.buffer = append(f.buffer, data)
+			f.buffered += len(data)
+			if !f.constrained {
+				log.Printf("Stream %d is now constrained.\n", f.streamID)
+			}
+			f.constrained = true
+			return l, nil
+		}
+
+		if err := f.wait(); err != nil {
+			return written, err
+		}
+	}
 }
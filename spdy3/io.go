@@ -41,6 +41,12 @@ func (c *Conn) readFrames() {
 
 		// Decompress the frame's headers, if there are any.
 		err = frame.Decompress(c.decompressor)
+		if limitErr, ok := err.(*common.HeaderLimitError); ok {
+			if c.handleHeaderLimit(frame, limitErr) {
+				return
+			}
+			continue
+		}
 		if c.criticalCheck(err != nil, 0, "Decompression: %v", err) {
 			return
 		}
@@ -66,44 +72,13 @@ func (c *Conn) send() {
 		}
 	}()
 
-	for i := 1; ; i++ {
-		if i >= 5 {
-			i = 0 // Once per 5 frames, pick randomly.
-		}
-
-		var frame common.Frame
-		if i == 0 { // Ignore priority.
-			frame = c.selectFrameToSend(false)
-		} else { // Normal selection.
-			frame = c.selectFrameToSend(true)
-		}
-
+	for {
+		frame := c.selectFrameToSend()
 		if frame == nil {
 			c.Close()
 			return
 		}
 
-		// Process connection-level flow control.
-		if c.Subversion > 0 {
-			if frame, ok := frame.(*frames.DATA); ok {
-				size := int64(8 + len(frame.Data))
-				if size > c.connectionWindowSize {
-					// Buffer this frame and try again.
-					if c.dataBuffer == nil {
-						c.dataBuffer = []*frames.DATA{frame}
-					} else {
-						buffer := make([]*frames.DATA, 1, len(c.dataBuffer)+1)
-						buffer[0] = frame
-						buffer = append(buffer, c.dataBuffer...)
-						c.dataBuffer = buffer
-					}
-					continue
-				} else {
-					c.connectionWindowSize -= size
-				}
-			}
-		}
-
 		// Compress any name/value header blocks.
 		err := frame.Compress(c.compressor)
 		if err != nil {
@@ -125,47 +100,33 @@ func (c *Conn) send() {
 	}
 }
 
-// selectFrameToSend follows the specification's guidance
-// on frame priority, sending frames with higher priority
-// (a smaller number) first. If the given boolean is false,
-// this priority is temporarily ignored, which can be used
-// when high load is ignoring low-priority frames.
-func (c *Conn) selectFrameToSend(prioritise bool) (frame common.Frame) {
-	if c.closed() {
-		return nil
-	}
+// maxQueuedFrames is the number of frames which
+// may be queued for sending before further frames
+// are held on the output channels, blocking their
+// senders.
+const maxQueuedFrames = 32
 
-	// Try buffered DATA frames first.
-	if c.Subversion > 0 {
-		if c.dataBuffer != nil {
-			if len(c.dataBuffer) == 0 {
-				c.dataBuffer = nil
-			} else {
-				first := c.dataBuffer[0]
-				if c.connectionWindowSize >= int64(8+len(first.Data)) {
-					if len(c.dataBuffer) > 1 {
-						c.dataBuffer = c.dataBuffer[1:]
-					} else {
-						c.dataBuffer = nil
-					}
-					return first
-				}
-			}
+// selectFrameToSend returns the next frame to send. Control
+// frames are sent first, followed by stream frames in the
+// order chosen by the connection's Scheduler.
+//
+// In SPDY/3.1, DATA frames are also subject to the session
+// window, so may be witheld and sent later.
+func (c *Conn) selectFrameToSend() common.Frame {
+	for {
+		if c.closed() {
+			return nil
 		}
-	}
 
-	// Then in priority order.
-	if prioritise {
-		for i := 0; i < 8; i++ {
-			select {
-			case frame = <-c.output[i]:
-				return frame
-			default:
-			}
+		if !c.queueFrames() {
+			return nil
+		}
+		if frame := c.nextFrame(); frame != nil {
+			return frame
 		}
 
 		// No frames are immediately pending, so if the
-		// cection is being closed, cease sending
+		// connection is being closed, cease sending
 		// safely.
 		c.sendingLock.Lock()
 		if c.sending != nil {
@@ -174,27 +135,218 @@ func (c *Conn) selectFrameToSend(prioritise bool) (frame common.Frame) {
 			runtime.Goexit()
 		}
 		c.sendingLock.Unlock()
+
+		if !c.waitForFrame() {
+			return nil
+		}
+	}
+}
+
+// queueFrames moves any frames pending on the output
+// channels into the queues, without blocking. Control
+// frames are always taken, as they are sent first. The
+// returned bool is false if the connection is closing.
+func (c *Conn) queueFrames() bool {
+	for drained := false; !drained; {
+		select {
+		case frame, ok := <-c.controlOutput:
+			if !ok {
+				return false
+			}
+			c.queueFrame(frame, 0)
+		default:
+			drained = true
+		}
 	}
 
-	// Wait for any frame.
+	for c.queued() < maxQueuedFrames {
+		received := false
+		for i := range c.output {
+			select {
+			case frame, ok := <-c.output[i]:
+				if !ok {
+					return false
+				}
+				c.queueFrame(frame, common.Priority(i))
+				received = true
+			default:
+			}
+		}
+
+		if !received {
+			break
+		}
+	}
+
+	return true
+}
+
+// waitForFrame waits for a frame to be sent, and
+// queues it. If the session window grows while
+// waiting, waitForFrame returns, so that witheld
+// frames can be retried. The returned bool is
+// false if the connection is closing.
+func (c *Conn) waitForFrame() bool {
+	var frame common.Frame
+	var priority common.Priority
+	var ok bool
+
 	select {
-	case frame = <-c.output[0]:
-		return frame
-	case frame = <-c.output[1]:
-		return frame
-	case frame = <-c.output[2]:
-		return frame
-	case frame = <-c.output[3]:
-		return frame
-	case frame = <-c.output[4]:
-		return frame
-	case frame = <-c.output[5]:
-		return frame
-	case frame = <-c.output[6]:
-		return frame
-	case frame = <-c.output[7]:
-		return frame
+	case frame, ok = <-c.controlOutput:
+		priority = 0
+	case frame, ok = <-c.output[0]:
+		priority = 0
+	case frame, ok = <-c.output[1]:
+		priority = 1
+	case frame, ok = <-c.output[2]:
+		priority = 2
+	case frame, ok = <-c.output[3]:
+		priority = 3
+	case frame, ok = <-c.output[4]:
+		priority = 4
+	case frame, ok = <-c.output[5]:
+		priority = 5
+	case frame, ok = <-c.output[6]:
+		priority = 6
+	case frame, ok = <-c.output[7]:
+		priority = 7
+	case _ = <-c.connectionWindowGrown:
+		return true
 	case _ = <-c.stop:
-		return nil
+		return false
+	}
+
+	if !ok {
+		return false
+	}
+	c.queueFrame(frame, priority)
+	return true
+}
+
+// queued returns the number of frames queued.
+func (c *Conn) queued() int {
+	c.schedulerLock.Lock()
+	defer c.schedulerLock.Unlock()
+	return len(c.control) + c.scheduler.Len()
+}
+
+// queueFrame adds a frame, sent at the given priority,
+// to the queues. Control frames are queued to be sent
+// first, and stream frames are given to the Scheduler.
+// A RST_STREAM drops any DATA queued for its stream,
+// but any headers queued are sent before it.
+func (c *Conn) queueFrame(frame common.Frame, priority common.Priority) {
+	c.schedulerLock.Lock()
+	defer c.schedulerLock.Unlock()
+
+	queued := common.QueuedFrame{Frame: frame, Priority: priority}
+	switch frame := frame.(type) {
+	case *frames.DATA:
+		queued.StreamID = frame.StreamID
+		queued.Size = len(frame.Data)
+		c.memory.Acquire(queued.Size)
+	case *frames.SYN_STREAM:
+		queued.StreamID = frame.StreamID
+	case *frames.SYN_REPLY:
+		queued.StreamID = frame.StreamID
+	case *frames.HEADERS:
+		queued.StreamID = frame.StreamID
+	case *frames.RST_STREAM:
+		c.control = append(c.control, c.discardFrames(frame.StreamID)...)
+		c.control = append(c.control, frame)
+		return
+	default:
+		c.control = append(c.control, frame)
+		return
+	}
+
+	// Frames sent before a change of
+	// priority take the new priority.
+	if priority, ok := c.priorities[queued.StreamID]; ok {
+		queued.Priority = priority
+	}
+	c.scheduler.Push(queued)
+}
+
+// setPriority changes the priority at which the
+// given stream's frames are sent, including any
+// already queued.
+func (c *Conn) setPriority(streamID common.StreamID, priority common.Priority) {
+	c.schedulerLock.Lock()
+	defer c.schedulerLock.Unlock()
+
+	c.priorities[streamID] = priority
+	c.scheduler.SetPriority(streamID, priority)
+	if c.session != nil {
+		c.session.SetPriority(streamID, priority)
+	}
+}
+
+// clearPriority forgets any change to the
+// priority of the given stream, once it
+// has closed.
+func (c *Conn) clearPriority(streamID common.StreamID) {
+	c.schedulerLock.Lock()
+	delete(c.priorities, streamID)
+	c.schedulerLock.Unlock()
+}
+
+// discardFrames drops any DATA queued for the
+// given stream, returning the other frames that
+// were queued for it, in order, so that the peer
+// sees the stream and any reply before it is
+// reset. The schedulerLock must be held.
+func (c *Conn) discardFrames(streamID common.StreamID) []common.Frame {
+	var kept []common.Frame
+	for _, queued := range c.scheduler.Discard(streamID) {
+		if data, ok := queued.Frame.(*frames.DATA); ok {
+			c.memory.Release(len(data.Data))
+		} else {
+			kept = append(kept, queued.Frame)
+		}
+	}
+	if c.session != nil {
+		c.session.Discard(streamID)
+	}
+	return kept
+}
+
+// nextFrame returns the next queued frame
+// which can be sent, or nil if there is none.
+func (c *Conn) nextFrame() common.Frame {
+	c.schedulerLock.Lock()
+	defer c.schedulerLock.Unlock()
+
+	if len(c.control) > 0 {
+		frame := c.control[0]
+		c.control[0] = nil
+		c.control = c.control[1:]
+		return frame
+	}
+
+	// Try witheld DATA frames first.
+	if c.Subversion > 0 {
+		if data := c.session.Next(); data != nil {
+			return data
+		}
+	}
+
+	for {
+		queued, ok := c.scheduler.Pop()
+		if !ok {
+			return nil
+		}
+
+		data, isData := queued.Frame.(*frames.DATA)
+		if !isData {
+			return queued.Frame
+		}
+		c.memory.Release(len(data.Data))
+		if c.Subversion == 0 {
+			return data
+		}
+		if data = c.session.Send(data, queued.Priority); data != nil {
+			return data
+		}
 	}
 }
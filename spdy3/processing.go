@@ -1,9 +1,11 @@
 package spdy3
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/SlyMarbo/spdy/common"
 	"github.com/SlyMarbo/spdy/spdy3/frames"
@@ -17,12 +19,18 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 	switch frame := frame.(type) {
 
 	case *frames.SYN_STREAM:
+		if c.abusive(common.AbuseStream) {
+			return true
+		}
 		if c.server == nil {
 			c.handlePush(frame)
 		} else {
 			c.handleRequest(frame)
 		}
 	case *frames.SYN_STREAMV3_1:
+		if c.abusive(common.AbuseStream) {
+			return true
+		}
 		f3 := new(frames.SYN_STREAM)
 		f3.Flags = frame.Flags
 		f3.StreamID = frame.StreamID
@@ -40,6 +48,10 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 		c.handleSynReply(frame)
 
 	case *frames.RST_STREAM:
+		if c.abusive(common.AbuseReset) {
+			return true
+		}
+		c.recordReset(frame.StreamID, frame.Status)
 		if frame.Status.IsFatal() {
 			code := frame.Status.String()
 			log.Printf("Warning: Received %s on stream %d. Closing connection.\n", code, frame.StreamID)
@@ -49,22 +61,17 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 		c.handleRstStream(frame)
 
 	case *frames.SETTINGS:
+		if c.abusive(common.AbuseSettings) {
+			return true
+		}
 		for _, setting := range frame.Settings {
 			c.receivedSettings[setting.ID] = setting
 			switch setting.ID {
 			case common.SETTINGS_INITIAL_WINDOW_SIZE:
+				// In SPDY/3.1, this applies only to
+				// stream windows, not the session's.
 				c.initialWindowSizeLock.Lock()
-				initial := int64(c.initialWindowSize)
-				current := c.connectionWindowSize
-				inbound := int64(setting.Value)
-				if initial != inbound {
-					if initial > inbound {
-						c.connectionWindowSize = inbound - (initial - current)
-					} else {
-						c.connectionWindowSize += (inbound - initial)
-					}
-					c.initialWindowSize = setting.Value
-				}
+				c.initialWindowSize = setting.Value
 				c.initialWindowSizeLock.Unlock()
 
 			case common.SETTINGS_MAX_CONCURRENT_STREAMS:
@@ -90,10 +97,16 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 			c.pings[frame.PingID] <- true
 			close(c.pings[frame.PingID])
 			delete(c.pings, frame.PingID)
+			sent := c.pingTimes[frame.PingID]
+			delete(c.pingTimes, frame.PingID)
 			c.pingsLock.Unlock()
+			c.observeRTT(time.Since(sent))
 		} else {
+			if c.abusive(common.AbusePing) {
+				return true
+			}
 			debug.Println("Received PING. Replying...")
-			c.output[0] <- frame
+			c.controlOutput <- frame
 		}
 
 	case *frames.GOAWAY:
@@ -133,32 +146,26 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 					Value: uint32(frame.Slot + 4),
 				},
 			}
-			c.output[0] <- setting
+			c.controlOutput <- setting
 			c.vectorIndex += 4
 		}
 		c.certificates[frame.Slot] = frame.Certificates
 
 	case *frames.DATA:
+		c.sampleRTT()
 		if c.Subversion > 0 {
+			c.connectionWindowLock.Lock()
+
 			// The transfer window shouldn't already be negative.
 			if c.connectionWindowSizeThere < 0 {
+				c.connectionWindowLock.Unlock()
 				c._GOAWAY(common.GOAWAY_FLOW_CONTROL_ERROR)
 				return false
 			}
 
 			c.connectionWindowSizeThere -= int64(len(frame.Data))
-
-			c.flowControlLock.Lock()
-			f := c.flowControl
-			c.flowControlLock.Unlock()
-			delta := f.ReceiveData(0, c.initialWindowSizeThere, c.connectionWindowSizeThere)
-			if delta != 0 {
-				grow := new(frames.WINDOW_UPDATE)
-				grow.StreamID = 0
-				grow.DeltaWindowSize = delta
-				c.output[0] <- grow
-				c.connectionWindowSizeThere += int64(grow.DeltaWindowSize)
-			}
+			c.regrowSessionWindow()
+			c.connectionWindowLock.Unlock()
 		}
 		if c.server == nil {
 			c.handleServerData(frame)
@@ -209,8 +216,12 @@ func (c *Conn) handleHeaders(frame *frames.HEADERS) {
 	// Handle push headers.
 	if sid&1 == 0 && c.server == nil {
 		// Ignore refused push headers.
-		if req := c.pushRequests[sid]; req != nil && c.PushReceiver != nil {
-			c.PushReceiver.ReceiveHeader(req, frame.Header)
+		if push := c.pushes[sid]; push != nil {
+			push.receiver.ReceiveHeader(push.request, frame.Header)
+			if frame.Flags.FIN() {
+				push.receiver.ReceiveData(push.request, nil, true)
+				c.endPush(sid, nil)
+			}
 		}
 		return
 	}
@@ -261,6 +272,13 @@ func (c *Conn) handlePush(frame *frames.SYN_STREAM) {
 
 	// Stream ID is fine.
 
+	// Refuse the stream while memory is scarce.
+	if c.memory.Pressure() {
+		c.memory.Refused()
+		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
+		return
+	}
+
 	// Check stream limit would allow the new stream.
 	if !c.pushStreamLimit.Add() {
 		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
@@ -300,21 +318,73 @@ func (c *Conn) handlePush(frame *frames.SYN_STREAM) {
 		TLS:        c.tlsState,
 	}
 
+	// Pushes go to the push receiver of the request
+	// they are associated with, if it has one, and
+	// are refused once that request has finished.
+	var assoc *http.Request
+	c.streamsLock.Lock()
+	stream, ok := c.streams[frame.AssocStreamID].(*RequestStream)
+	c.streamsLock.Unlock()
+	if ok {
+		assoc = stream.pushRequest()
+	}
+	receiver := c.PushReceiver
+	if assoc != nil {
+		if r := common.PushReceiverFromContext(assoc.Context()); r != nil {
+			receiver = r
+		}
+	}
+	if receiver == nil || assoc == nil {
+		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
+		c.pushStreamLimit.Close()
+		return
+	}
+
+	// The pushed request's context carries the
+	// associated request, and ends with the push.
+	ctx := common.ContextWithAssociatedRequest(c.baseContext, assoc)
+	ctx, cancel := context.WithCancelCause(ctx)
+	request = request.WithContext(ctx)
+	c.pushes[sid] = &receivedPush{request: request, receiver: receiver, cancel: cancel}
+
 	// Check whether the receiver wants this resource.
-	if c.PushReceiver != nil && !c.PushReceiver.ReceiveRequest(request) {
+	if !receiver.ReceiveRequest(request) {
 		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
+		c.endPush(sid, nil)
 		return
 	}
 
-	if c.PushReceiver != nil {
-		c.pushRequests[sid] = request
-		c.lastPushStreamIDLock.Lock()
-		c.lastPushStreamID = sid
-		c.lastPushStreamIDLock.Unlock()
-		c.PushReceiver.ReceiveHeader(request, frame.Header)
+	c.lastPushStreamIDLock.Lock()
+	c.lastPushStreamID = sid
+	c.lastPushStreamIDLock.Unlock()
+	receiver.ReceiveHeader(request, frame.Header)
+	if frame.Flags.FIN() {
+		receiver.ReceiveData(request, nil, true)
+		c.endPush(sid, nil)
 	}
 }
 
+// receivedPush is the state of a push
+// received from the server.
+type receivedPush struct {
+	request  *http.Request
+	receiver common.Receiver
+	cancel   context.CancelCauseFunc // ends the request's context.
+}
+
+// endPush releases the state of a push received
+// from the server, ending its request's context
+// with the given cause.
+func (c *Conn) endPush(sid common.StreamID, cause error) {
+	push := c.pushes[sid]
+	if push == nil {
+		return
+	}
+	push.cancel(cause)
+	delete(c.pushes, sid)
+	c.pushStreamLimit.Close()
+}
+
 // handleRequest performs the processing of SYN_STREAM request frames.
 func (c *Conn) handleRequest(frame *frames.SYN_STREAM) {
 	// Check stream creation is allowed.
@@ -348,6 +418,13 @@ func (c *Conn) handleRequest(frame *frames.SYN_STREAM) {
 
 	// Stream ID is fine.
 
+	// Refuse the stream while memory is scarce.
+	if c.memory.Pressure() {
+		c.memory.Refused()
+		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
+		return
+	}
+
 	// Check stream limit would allow the new stream.
 	if !c.requestStreamLimit.Add() {
 		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
@@ -362,6 +439,7 @@ func (c *Conn) handleRequest(frame *frames.SYN_STREAM) {
 	// Create and start new stream.
 	nextStream := c.newStream(frame)
 	if nextStream == nil {
+		c.requestStreamLimit.Close()
 		return
 	}
 
@@ -381,6 +459,24 @@ func (c *Conn) handleRstStream(frame *frames.RST_STREAM) {
 	stream := c.streams[sid]
 	c.streamsLock.Unlock()
 
+	// Tell the pusher why the push ended.
+	if push, ok := stream.(*PushStream); ok {
+		if frame.Status == common.RST_STREAM_CANCEL || frame.Status == common.RST_STREAM_REFUSED_STREAM {
+			c.pushAccount.Refused()
+		}
+		push.reset(frame.Status)
+	}
+
+	// Drop any data witheld for the stream.
+	if c.session != nil {
+		c.session.Discard(sid)
+	}
+
+	// End pushes received from the server.
+	if c.server == nil && sid&1 == 0 {
+		c.endPush(sid, &common.StreamResetError{StreamID: sid, Status: frame.Status})
+	}
+
 	// Determine the status code and react accordingly.
 	switch frame.Status {
 	case common.RST_STREAM_INVALID_STREAM,
@@ -397,7 +493,8 @@ func (c *Conn) handleRstStream(frame *frames.RST_STREAM) {
 			return
 		}
 		fallthrough
-	case common.RST_STREAM_REFUSED_STREAM:
+	case common.RST_STREAM_REFUSED_STREAM,
+		common.RST_STREAM_INTERNAL_ERROR:
 		if stream != nil {
 			go stream.Close()
 		}
@@ -422,8 +519,11 @@ func (c *Conn) handleServerData(frame *frames.DATA) {
 
 	if sid&1 == 0 { // Handle push data.
 		// Ignore refused push data.
-		if req := c.pushRequests[sid]; req != nil && c.PushReceiver != nil {
-			c.PushReceiver.ReceiveData(req, frame.Data, frame.Flags.FIN())
+		if push := c.pushes[sid]; push != nil {
+			push.receiver.ReceiveData(push.request, frame.Data, frame.Flags.FIN())
+			if frame.Flags.FIN() {
+				c.endPush(sid, nil)
+			}
 		}
 		return
 	}
@@ -485,22 +585,20 @@ func (c *Conn) handleWindowUpdate(frame *frames.WINDOW_UPDATE) {
 
 	// Handle connection-level flow control.
 	if sid.Zero() && c.Subversion > 0 {
-		if int64(delta)+c.connectionWindowSize > common.MAX_TRANSFER_WINDOW_SIZE {
+		if err := c.session.Grow(delta); err != nil {
 			goaway := new(frames.GOAWAY)
-			if c.server != nil {
-				c.lastRequestStreamIDLock.Lock()
-				goaway.LastGoodStreamID = c.lastRequestStreamID
-				c.lastRequestStreamIDLock.Unlock()
-			} else {
-				c.lastPushStreamIDLock.Lock()
-				goaway.LastGoodStreamID = c.lastPushStreamID
-				c.lastPushStreamIDLock.Unlock()
-			}
+			goaway.LastGoodStreamID = c.lastGoodStreamID()
 			goaway.Status = common.GOAWAY_FLOW_CONTROL_ERROR
-			c.output[0] <- goaway
+			c.controlOutput <- goaway
 			return
 		}
-		c.connectionWindowSize += int64(delta)
+
+		// Wake the sender, in case it is
+		// waiting to send witheld frames.
+		select {
+		case c.connectionWindowGrown <- struct{}{}:
+		default:
+		}
 		return
 	}
 
@@ -5,10 +5,12 @@
 package spdy3
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/SlyMarbo/spdy/common"
 	"github.com/SlyMarbo/spdy/spdy3/frames"
@@ -23,12 +25,19 @@ type PushStream struct {
 	shutdownOnce sync.Once
 	conn         *Conn
 	streamID     common.StreamID
+	priority     common.Priority
 	flow         *flowControl
 	origin       common.Stream
+	originID     common.StreamID
 	state        *common.StreamState
 	output       chan<- common.Frame
 	header       http.Header
 	stop         <-chan bool
+	record       *common.StreamRecorder
+	ctx          context.Context
+	cancel       context.CancelFunc
+	err          error      // set if the client resets the push.
+	errLock      sync.Mutex // protects err.
 }
 
 func NewPushStream(conn *Conn, streamID common.StreamID, origin common.Stream, output chan<- common.Frame) *PushStream {
@@ -36,10 +45,12 @@ func NewPushStream(conn *Conn, streamID common.StreamID, origin common.Stream, o
 	out.conn = conn
 	out.streamID = streamID
 	out.origin = origin
+	out.originID = origin.StreamID()
 	out.output = output
 	out.stop = conn.stop
 	out.state = new(common.StreamState)
 	out.header = make(http.Header)
+	out.ctx, out.cancel = context.WithCancel(conn.baseContext)
 	return out
 }
 
@@ -53,6 +64,9 @@ func (p *PushStream) Header() http.Header {
 
 // Write is used for sending data in the push.
 func (p *PushStream) Write(inputData []byte) (int, error) {
+	if err := p.Err(); err != nil {
+		return 0, err
+	}
 	if p.closed() || p.state.ClosedHere() {
 		return 0, errors.New("Error: Stream already closed.")
 	}
@@ -62,6 +76,14 @@ func (p *PushStream) Write(inputData []byte) (int, error) {
 		return 0, errors.New("Error: Origin stream is closed.")
 	}
 
+	// Only as much data as the push
+	// budget allows is sent.
+	allowed, budgetErr := p.conn.pushAccount.Reserve(p.originID, len(inputData))
+	if allowed == 0 && budgetErr != nil {
+		return 0, budgetErr
+	}
+	inputData = inputData[:allowed]
+
 	p.writeHeader()
 
 	// Copy the data locally to avoid any pointer issues.
@@ -83,6 +105,10 @@ func (p *PushStream) Write(inputData []byte) (int, error) {
 
 	n, err := p.flow.Write(data)
 	written += n
+	p.record.Sent(written)
+	if err == nil {
+		err = budgetErr
+	}
 
 	return written, err
 }
@@ -94,6 +120,33 @@ func (p *PushStream) WriteHeader(int) {
 	return
 }
 
+/****************
+ * http.Flusher *
+ ****************/
+
+// Flush sends any pending headers to the client
+// immediately, along with any data held back by
+// flow control, as far as the transfer window
+// allows.
+func (p *PushStream) Flush() {
+	if p.closed() || p.state.ClosedHere() {
+		return
+	}
+
+	p.writeHeader()
+
+	p.flow.Lock()
+	p.flow.Flush()
+	p.flow.Unlock()
+}
+
+// SetWriteDeadline sets the time after which writes
+// blocked by flow control fail with common.ErrTimeout.
+func (p *PushStream) SetWriteDeadline(t time.Time) error {
+	p.flow.SetWriteDeadline(t)
+	return nil
+}
+
 /*****************
  * io.Closer *
  *****************/
@@ -106,6 +159,8 @@ func (p *PushStream) Close() error {
 }
 
 func (p *PushStream) shutdown() {
+	p.cancel()
+	p.record.Finish(common.StreamGoaway, 0)
 	p.writeHeader()
 	if p.state != nil {
 		p.state.Close()
@@ -113,6 +168,7 @@ func (p *PushStream) shutdown() {
 	if p.flow != nil {
 		p.flow.Close()
 	}
+	p.conn.clearPriority(p.streamID)
 	p.origin = nil
 	p.output = nil
 	p.header = nil
@@ -143,7 +199,7 @@ func (p *PushStream) ReceiveFrame(frame common.Frame) error {
 			reply := new(frames.RST_STREAM)
 			reply.StreamID = p.streamID
 			reply.Status = common.RST_STREAM_FLOW_CONTROL_ERROR
-			p.output <- reply
+			p.conn.controlOutput <- reply
 			return err
 		}
 
@@ -170,20 +226,71 @@ func (p *PushStream) StreamID() common.StreamID {
 	return p.streamID
 }
 
+func (p *PushStream) Priority() common.Priority {
+	p.Lock()
+	defer p.Unlock()
+	return p.priority
+}
+
+// SetPriority changes the priority at which the
+// stream's frames are sent, including any already
+// queued. SPDY/3 cannot signal the change, so it
+// affects only the frames sent by this endpoint.
+func (p *PushStream) SetPriority(priority common.Priority) error {
+	if !priority.Valid(3) {
+		return errors.New("Error: Invalid priority.")
+	}
+	p.Lock()
+	p.priority = priority
+	p.Unlock()
+	p.conn.setPriority(p.streamID, priority)
+	return nil
+}
+
 /**************
  * PushStream *
  **************/
 
 func (p *PushStream) Finish() {
+	if p.Err() != nil || p.closed() || p.state.ClosedHere() {
+		p.Close()
+		return
+	}
+
 	p.writeHeader()
+
+	// Wait for any buffered data to be sent.
+	if err := p.flow.Drain(); err != nil {
+		p.Close()
+		return
+	}
+
 	end := new(frames.DATA)
 	end.StreamID = p.streamID
 	end.Data = []byte{}
 	end.Flags = common.FLAG_FIN
 	p.output <- end
+	p.record.Finish(common.StreamFinished, 0)
 	p.Close()
 }
 
+// Context returns a context that is done once
+// the push has ended, such as when the client
+// cancels or refuses it, or the connection
+// closes. Handlers generating pushed content
+// can use it to stop early.
+func (p *PushStream) Context() context.Context {
+	return p.ctx
+}
+
+// Err returns a *common.StreamResetError if the
+// client has reset the push, or nil otherwise.
+func (p *PushStream) Err() error {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	return p.err
+}
+
 /**********
  * Others *
  **********/
@@ -224,3 +331,18 @@ func (p *PushStream) writeHeader() {
 
 	p.output <- header
 }
+
+func (p *PushStream) accessRecord() *common.StreamRecorder {
+	return p.record
+}
+
+// reset records that the client has reset
+// the push, and ends its context.
+func (p *PushStream) reset(status common.StatusCode) {
+	p.errLock.Lock()
+	if p.err == nil {
+		p.err = &common.StreamResetError{StreamID: p.streamID, Status: status}
+	}
+	p.errLock.Unlock()
+	p.cancel()
+}
@@ -7,8 +7,10 @@ package spdy3
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/SlyMarbo/spdy/common"
 	"github.com/SlyMarbo/spdy/spdy3/frames"
@@ -24,13 +26,16 @@ type RequestStream struct {
 
 	recvMutex    sync.Mutex
 	shutdownOnce sync.Once
+	finishOnce   sync.Once
 	conn         *Conn
 	streamID     common.StreamID
+	priority     common.Priority
 	flow         *flowControl
 	state        *common.StreamState
 	output       chan<- common.Frame
 	header       http.Header
 	headerChan   chan func()
+	closing      chan struct{} // closed once the stream starts to close.
 	responseCode int
 	stop         <-chan bool
 	finished     chan struct{}
@@ -43,10 +48,10 @@ func NewRequestStream(conn *Conn, streamID common.StreamID, output chan<- common
 	out.output = output
 	out.stop = conn.stop
 	out.state = new(common.StreamState)
-	out.state.CloseHere()
 	out.header = make(http.Header)
 	out.finished = make(chan struct{})
 	out.headerChan = make(chan func(), 5)
+	out.closing = make(chan struct{})
 	go out.processFrames()
 	return out
 }
@@ -96,6 +101,13 @@ func (s *RequestStream) Write(inputData []byte) (int, error) {
 	return written, nil
 }
 
+// SetWriteDeadline sets the time after which writes
+// blocked by flow control fail with common.ErrTimeout.
+func (s *RequestStream) SetWriteDeadline(t time.Time) error {
+	s.flow.SetWriteDeadline(t)
+	return nil
+}
+
 // WriteHeader is used to set the HTTP status code.
 func (s *RequestStream) WriteHeader(int) {
 	s.writeHeader()
@@ -121,26 +133,30 @@ func (s *RequestStream) shutdown() {
 			rst := new(frames.RST_STREAM)
 			rst.StreamID = s.streamID
 			rst.Status = common.RST_STREAM_CANCEL
-			s.output <- rst
+			select {
+			case s.conn.controlOutput <- rst:
+			case <-s.conn.stop: // The connection is closing.
+			}
 		}
 		s.state.Close()
 	}
 	if s.flow != nil {
 		s.flow.Close()
 	}
-	select {
-	case <-s.finished:
-	default:
-		close(s.finished)
-	}
-	select {
-	case <-s.headerChan:
-	default:
-		close(s.headerChan)
-	}
-	s.output = nil
+	s.conn.clearPriority(s.streamID)
+
+	// Frames already received are still
+	// passed to the Receiver, and the stream
+	// is finished once they have been. This
+	// does not wait, as Close may be called
+	// by the Receiver.
+	close(s.closing)
+	s.recvMutex.Lock()
+	close(s.headerChan)
 	s.Request = nil
 	s.Receiver = nil
+	s.recvMutex.Unlock()
+	s.output = nil
 	s.header = nil
 	s.stop = nil
 }
@@ -161,6 +177,14 @@ func (s *RequestStream) ReceiveFrame(frame common.Frame) error {
 		return errors.New("Nil frame received.")
 	}
 
+	if s.closed() {
+		return errors.New("Error: Stream already closed.")
+	}
+
+	// The Receiver is called in order, but may be
+	// called after the stream has been closed.
+	receiver, request := s.Receiver, s.Request
+
 	// Process the frame depending on its type.
 	switch frame := frame.(type) {
 	case *frames.DATA:
@@ -172,35 +196,37 @@ func (s *RequestStream) ReceiveFrame(frame common.Frame) error {
 		}
 
 		// Give to the client.
-		s.flow.Receive(frame.Data)
-		s.headerChan <- func() {
-			s.Receiver.ReceiveData(s.Request, data, frame.Flags.FIN())
+		if err := s.flow.Receive(frame.Data); err != nil {
+			return err
+		}
+		s.deliver(func() {
+			receiver.ReceiveData(request, data, frame.Flags.FIN())
 
 			if frame.Flags.FIN() {
 				s.state.CloseThere()
-				close(s.finished)
+				s.finish()
 			}
-		}
+		})
 
 	case *frames.SYN_REPLY:
-		s.headerChan <- func() {
-			s.Receiver.ReceiveHeader(s.Request, frame.Header)
+		s.deliver(func() {
+			receiver.ReceiveHeader(request, frame.Header)
 
 			if frame.Flags.FIN() {
 				s.state.CloseThere()
-				close(s.finished)
+				s.finish()
 			}
-		}
+		})
 
 	case *frames.HEADERS:
-		s.headerChan <- func() {
-			s.Receiver.ReceiveHeader(s.Request, frame.Header)
+		s.deliver(func() {
+			receiver.ReceiveHeader(request, frame.Header)
 
 			if frame.Flags.FIN() {
 				s.state.CloseThere()
-				close(s.finished)
+				s.finish()
 			}
-		}
+		})
 
 	case *frames.WINDOW_UPDATE:
 		err := s.flow.UpdateWindow(frame.DeltaWindowSize)
@@ -208,7 +234,7 @@ func (s *RequestStream) ReceiveFrame(frame common.Frame) error {
 			reply := new(frames.RST_STREAM)
 			reply.StreamID = s.streamID
 			reply.Status = common.RST_STREAM_FLOW_CONTROL_ERROR
-			s.output <- reply
+			s.conn.controlOutput <- reply
 		}
 
 	default:
@@ -231,7 +257,10 @@ func (s *RequestStream) Run() error {
 	<-s.finished
 
 	// Make sure any queued data has been sent.
-	if s.flow.Paused() {
+	s.flow.Lock()
+	paused := s.flow.Paused()
+	s.flow.Unlock()
+	if paused {
 		return errors.New(fmt.Sprintf("Error: Stream %d has been closed with data still buffered.\n", s.streamID))
 	}
 
@@ -240,6 +269,14 @@ func (s *RequestStream) Run() error {
 	return nil
 }
 
+// finish is used to signal that the
+// response has been received in full.
+func (s *RequestStream) finish() {
+	s.finishOnce.Do(func() {
+		close(s.finished)
+	})
+}
+
 func (s *RequestStream) State() *common.StreamState {
 	return s.state
 }
@@ -248,6 +285,27 @@ func (s *RequestStream) StreamID() common.StreamID {
 	return s.streamID
 }
 
+func (s *RequestStream) Priority() common.Priority {
+	s.Lock()
+	defer s.Unlock()
+	return s.priority
+}
+
+// SetPriority changes the priority at which the
+// stream's frames are sent, including any already
+// queued. SPDY/3 cannot signal the change, so it
+// affects only the frames sent by this endpoint.
+func (s *RequestStream) SetPriority(priority common.Priority) error {
+	if !priority.Valid(3) {
+		return errors.New("Error: Invalid priority.")
+	}
+	s.Lock()
+	s.priority = priority
+	s.Unlock()
+	s.conn.setPriority(s.streamID, priority)
+	return nil
+}
+
 func (s *RequestStream) closed() bool {
 	if s.conn == nil || s.state == nil || s.Receiver == nil {
 		return true
@@ -282,8 +340,55 @@ func (s *RequestStream) writeHeader() {
 	s.output <- header
 }
 
+// sendBody sends the request body as it is read,
+// followed by the FIN.
+func (s *RequestStream) sendBody(body io.Reader) error {
+	for {
+		// The flow control keeps the data it
+		// cannot send yet, so each read uses a
+		// new buffer.
+		buf := make([]byte, 32*1024)
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := s.flow.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			s.flow.Finish()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// deliver queues f to be called by processFrames,
+// unless the stream is closing. The recvMutex must
+// be held.
+func (s *RequestStream) deliver(f func()) {
+	select {
+	case s.headerChan <- f:
+	case <-s.closing:
+	}
+}
+
 func (s *RequestStream) processFrames() {
+	defer s.finish()
 	for f := range s.headerChan {
 		f()
 	}
 }
+
+// pushRequest returns the stream's request, or
+// nil if the stream has finished, so server
+// pushes can no longer be associated with it.
+func (s *RequestStream) pushRequest() *http.Request {
+	s.recvMutex.Lock()
+	defer s.recvMutex.Unlock()
+	if s.state.ClosedThere() {
+		return nil
+	}
+	return s.Request
+}
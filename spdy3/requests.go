@@ -3,7 +3,6 @@ package spdy3
 import (
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"strings"
 
@@ -63,42 +62,16 @@ func (c *Conn) Request(request *http.Request, receiver common.Receiver, priority
 	syn.Header.Set(":host", host)
 	syn.Header.Set(":scheme", url.Scheme)
 
-	// Prepare the request body, if any.
-	body := make([]*frames.DATA, 0, 1)
-	if request.Body != nil {
-		buf := make([]byte, 32*1024)
-		n, err := request.Body.Read(buf)
-		if err != nil && err != io.EOF {
-			return nil, err
-		}
-		total := n
-		for n > 0 {
-			data := new(frames.DATA)
-			data.Data = make([]byte, n)
-			copy(data.Data, buf[:n])
-			body = append(body, data)
-			n, err = request.Body.Read(buf)
-			if err != nil && err != io.EOF {
-				return nil, err
-			}
-			total += n
-		}
-
-		// Half-close the stream.
-		if len(body) == 0 {
-			syn.Flags = common.FLAG_FIN
-		} else {
-			syn.Header.Set("Content-Length", fmt.Sprint(total))
-			body[len(body)-1].Flags = common.FLAG_FIN
-		}
-		request.Body.Close()
-	} else {
+	// The request body, if any, is sent once the
+	// stream has been created.
+	if request.Body == nil || request.Body == http.NoBody {
 		syn.Flags = common.FLAG_FIN
+	} else if request.ContentLength > 0 {
+		syn.Header.Set("Content-Length", fmt.Sprint(request.ContentLength))
 	}
 
 	// Send.
 	c.streamCreation.Lock()
-	defer c.streamCreation.Unlock()
 
 	c.lastRequestStreamIDLock.Lock()
 	if c.lastRequestStreamID == 0 {
@@ -109,22 +82,45 @@ func (c *Conn) Request(request *http.Request, receiver common.Receiver, priority
 	syn.StreamID = c.lastRequestStreamID
 	c.lastRequestStreamIDLock.Unlock()
 	if syn.StreamID > common.MAX_STREAM_ID {
+		c.streamCreation.Unlock()
 		return nil, errors.New("Error: All client streams exhausted.")
 	}
 	c.output[0] <- syn
-	for _, frame := range body {
-		frame.StreamID = syn.StreamID
-		c.output[0] <- frame
-	}
 
 	// Create the request stream.
 	out := NewRequestStream(c, syn.StreamID, c.output[0])
+	out.priority = priority
 	out.Request = request
 	out.Receiver = receiver
 	out.AddFlowControl(c.flowControl)
+	if f := common.FlowControlFromContext(request.Context()); f != nil {
+		out.SetFlowControl(f)
+	}
 	c.streamsLock.Lock()
 	c.streams[syn.StreamID] = out // Store in the connection map.
 	c.streamsLock.Unlock()
+	c.streamCreation.Unlock()
+
+	if syn.Flags.FIN() {
+		out.state.CloseHere()
+		return out, nil
+	}
+
+	// Send the request body as it is read. The
+	// server's transfer window is respected, with
+	// the FIN sent after the last data. Writes may
+	// block until the window grows.
+	err := out.sendBody(request.Body)
+	request.Body.Close()
+	if err != nil {
+		// Reset the stream and release its slot.
+		out.Close()
+		c.streamsLock.Lock()
+		delete(c.streams, syn.StreamID)
+		c.streamsLock.Unlock()
+		c.requestStreamLimit.Close()
+		return nil, err
+	}
 
 	return out, nil
 }
@@ -5,12 +5,14 @@
 package spdy3
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/SlyMarbo/spdy/common"
 	"github.com/SlyMarbo/spdy/spdy3/frames"
@@ -26,7 +28,7 @@ type ResponseStream struct {
 	conn           *Conn
 	streamID       common.StreamID
 	flow           *flowControl
-	requestBody    *bytes.Buffer
+	requestBody    *requestBody
 	state          *common.StreamState
 	output         chan<- common.Frame
 	request        *http.Request
@@ -36,8 +38,12 @@ type ResponseStream struct {
 	unidirectional bool
 	responseCode   int
 	stop           chan bool
-	ready          chan struct{}
+	closeNotify    chan bool
+	cancel         context.CancelFunc
 	wroteHeader    bool
+	hijacked       bool
+	pushes         sync.WaitGroup // preloaded resources being pushed.
+	record         *common.StreamRecorder
 }
 
 func NewResponseStream(conn *Conn, frame *frames.SYN_STREAM, output chan<- common.Frame, handler http.Handler, request *http.Request) *ResponseStream {
@@ -49,21 +55,27 @@ func NewResponseStream(conn *Conn, frame *frames.SYN_STREAM, output chan<- commo
 	if out.handler == nil {
 		out.handler = http.DefaultServeMux
 	}
-	out.request = request
+	out.closeNotify = make(chan bool)
+
+	// The request's context is cancelled if the
+	// stream is reset or the connection closes.
+	ctx, cancel := context.WithCancel(conn.baseContext)
+	out.request = request.WithContext(ctx)
+	out.cancel = cancel
 	out.priority = frame.Priority
 	out.stop = conn.stop
 	out.unidirectional = frame.Flags.UNIDIRECTIONAL()
-	out.requestBody = new(bytes.Buffer)
+	out.record = common.NewStreamRecorder(conn.config.AccessLogger, conn.id, frame.StreamID, conn.version(), frame.Priority, out.request, false)
+	out.requestBody = newRequestBody(out)
 	out.state = new(common.StreamState)
 	out.header = make(http.Header)
 	out.responseCode = 0
-	out.ready = make(chan struct{})
 	out.wroteHeader = false
 	if frame.Flags.FIN() {
-		close(out.ready)
+		out.requestBody.CloseWithError(nil)
 		out.state.CloseThere()
 	}
-	out.request.Body = &common.ReadCloser{out.requestBody}
+	out.request.Body = out.requestBody
 	return out
 }
 
@@ -104,6 +116,7 @@ func (s *ResponseStream) Write(inputData []byte) (int, error) {
 	for len(data) > common.MAX_DATA_SIZE {
 		n, err := s.flow.Write(data[:common.MAX_DATA_SIZE])
 		if err != nil {
+			s.record.Sent(written)
 			return written, err
 		}
 		written += n
@@ -112,6 +125,7 @@ func (s *ResponseStream) Write(inputData []byte) (int, error) {
 
 	n, err := s.flow.Write(data)
 	written += n
+	s.record.Sent(written)
 
 	return written, err
 }
@@ -128,8 +142,15 @@ func (s *ResponseStream) WriteHeader(code int) {
 		return
 	}
 
+	// Push any preloaded resources before the
+	// response that refers to them.
+	if code != 204 && code != 304 && code/100 != 1 {
+		s.pushPreloads()
+	}
+
 	s.wroteHeader = true
 	s.responseCode = code
+	s.record.WroteHeader(code)
 	s.header.Set(":status", strconv.Itoa(code))
 	s.header.Set(":version", "HTTP/1.1")
 
@@ -155,6 +176,40 @@ func (s *ResponseStream) WriteHeader(code int) {
 	s.output <- synReply
 }
 
+/****************
+ * http.Flusher *
+ ****************/
+
+// Flush sends any pending headers to the client
+// immediately, along with any data held back by
+// flow control, as far as the transfer window
+// allows.
+func (s *ResponseStream) Flush() {
+	if s.unidirectional || s.closed() || s.state.ClosedHere() {
+		return
+	}
+
+	// Default to 200 response.
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+
+	// Send any new headers.
+	s.writeHeader()
+
+	s.flow.Lock()
+	s.flow.Flush()
+	s.flow.Unlock()
+}
+
+// SetWriteDeadline sets the time after which writes
+// blocked by flow control fail with common.ErrTimeout.
+// It can be used with http.ResponseController.
+func (s *ResponseStream) SetWriteDeadline(t time.Time) error {
+	s.flow.SetWriteDeadline(t)
+	return nil
+}
+
 /*****************
  * io.Closer *
  *****************/
@@ -167,6 +222,8 @@ func (s *ResponseStream) Close() error {
 }
 
 func (s *ResponseStream) shutdown() {
+	s.conn.pushesDone(s)
+	s.record.Finish(common.StreamGoaway, 0)
 	s.writeHeader()
 	if s.state != nil {
 		s.state.Close()
@@ -174,10 +231,14 @@ func (s *ResponseStream) shutdown() {
 	if s.flow != nil {
 		s.flow.Close()
 	}
+	s.conn.clearPriority(s.streamID)
 	if s.requestBody != nil {
-		s.requestBody.Reset()
-		s.requestBody = nil
+		s.requestBody.CloseWithError(common.ErrStreamClosed)
+	}
+	if s.cancel != nil {
+		s.cancel()
 	}
+	close(s.closeNotify)
 	s.output = nil
 	s.request = nil
 	s.handler = nil
@@ -204,25 +265,29 @@ func (s *ResponseStream) ReceiveFrame(frame common.Frame) error {
 	// Process the frame depending on its type.
 	switch frame := frame.(type) {
 	case *frames.DATA:
-		s.requestBody.Write(frame.Data)
-		s.flow.Receive(frame.Data)
+		if err := s.flow.Receive(frame.Data); err != nil {
+			s.record.Finish(common.StreamReset, common.RST_STREAM_FLOW_CONTROL_ERROR)
+			s.requestBody.CloseWithError(err)
+			go s.Close()
+			return err
+		}
+		s.record.Received(len(frame.Data))
+
+		// Data received after the body has been
+		// closed is discarded, so its window is
+		// returned immediately.
+		if _, err := s.requestBody.Write(frame.Data); err != nil {
+			s.flow.Consume(len(frame.Data))
+		}
 		if frame.Flags.FIN() {
-			select {
-			case <-s.ready:
-			default:
-				close(s.ready)
-			}
+			s.requestBody.CloseWithError(nil)
 			s.state.CloseThere()
 		}
 
 	case *frames.SYN_REPLY:
 		common.UpdateHeader(s.header, frame.Header)
 		if frame.Flags.FIN() {
-			select {
-			case <-s.ready:
-			default:
-				close(s.ready)
-			}
+			s.requestBody.CloseWithError(nil)
 			s.state.CloseThere()
 		}
 
@@ -235,7 +300,8 @@ func (s *ResponseStream) ReceiveFrame(frame common.Frame) error {
 			reply := new(frames.RST_STREAM)
 			reply.StreamID = s.streamID
 			reply.Status = common.RST_STREAM_FLOW_CONTROL_ERROR
-			s.output <- reply
+			s.conn.controlOutput <- reply
+			s.record.Finish(common.StreamReset, reply.Status)
 			return err
 		}
 
@@ -246,8 +312,11 @@ func (s *ResponseStream) ReceiveFrame(frame common.Frame) error {
 	return nil
 }
 
+// CloseNotify returns a channel which is closed
+// if the stream is reset by the client or the
+// connection closes.
 func (s *ResponseStream) CloseNotify() <-chan bool {
-	return s.stop
+	return s.closeNotify
 }
 
 // run is the main control path of
@@ -259,31 +328,44 @@ func (s *ResponseStream) Run() error {
 	// Catch any panics.
 	defer func() {
 		if v := recover(); v != nil {
-			if s != nil && s.state != nil && !s.state.Closed() {
-				log.Println("Encountered stream error:", v)
-			}
+			s.handlerPanic(v)
 		}
 	}()
 
-	// Make sure Request is prepared.
-	if s.requestBody == nil || s.request.Body == nil {
-		s.requestBody = new(bytes.Buffer)
-		s.request.Body = &common.ReadCloser{s.requestBody}
+	// Make sure Request is prepared. The
+	// stream may have been closed already,
+	// such as if the connection has closed.
+	s.Lock()
+	handler, request := s.handler, s.request
+	if handler == nil {
+		s.Unlock()
+		return nil
 	}
-
-	// Wait until the full request has been received.
-	<-s.ready
+	if s.requestBody == nil || request.Body == nil {
+		s.requestBody = newRequestBody(s)
+		request.Body = s.requestBody
+	}
+	s.Unlock()
 
 	/***************
 	 *** HANDLER ***
 	 ***************/
-	s.handler.ServeHTTP(s, s.request)
+	handler.ServeHTTP(s, request)
+	s.pushes.Wait()
 
-	// Make sure any queued data has been sent.
-	if s.flow.Paused() && s.state.OpenThere() {
-		s.flow.Flush()
+	// Hijacked streams are closed by the
+	// handler, ending the request's context.
+	if s.hijacked {
+		return nil
 	}
-	if s.flow.Paused() {
+	s.cancel()
+
+	// Discard any unread request body,
+	// returning its transfer window.
+	s.requestBody.Close()
+
+	// Wait for any buffered data to be sent.
+	if err := s.flow.Drain(); err != nil {
 		log.Printf("Error: Stream %d has been closed with data still buffered.\n", s.streamID)
 	}
 
@@ -292,9 +374,15 @@ func (s *ResponseStream) Run() error {
 	// frame, if a SYN_REPLY has been sent
 	// already.
 	// If the stream is already closed at
-	// this end, then nothing happens.
-	if !s.unidirectional {
+	// this end, then nothing happens. The frame
+	// is prepared with the lock held, as the
+	// connection may be closing the stream.
+	var final common.Frame
+	s.Lock()
+	output := s.output
+	if !s.unidirectional && s.output != nil {
 		if s.state.OpenHere() && !s.wroteHeader {
+			s.record.WroteHeader(http.StatusOK)
 			s.header.Set(":status", "200")
 			s.header.Set(":version", "HTTP/1.1")
 
@@ -311,7 +399,7 @@ func (s *ResponseStream) Run() error {
 				s.header.Del(name)
 			}
 
-			s.output <- synReply
+			final = synReply
 		} else if s.state.OpenHere() {
 			// Create the DATA.
 			data := new(frames.DATA)
@@ -319,15 +407,112 @@ func (s *ResponseStream) Run() error {
 			data.Flags = common.FLAG_FIN
 			data.Data = []byte{}
 
-			s.output <- data
+			final = data
 		}
 	}
+	s.Unlock()
+	if final != nil {
+		output <- final
+	}
 
 	// Clean up state.
 	s.state.CloseHere()
+	s.record.Finish(common.StreamFinished, 0)
 	return nil
 }
 
+// handlerPanic is called when the handler panics. If
+// no response has been sent, the client is sent a 500
+// response. Otherwise, the stream is reset. Either way,
+// the connection continues to serve other streams.
+func (s *ResponseStream) handlerPanic(v interface{}) {
+	if s.closed() || s.state.Closed() {
+		return
+	}
+
+	common.ReportHandlerPanic(s.streamID, s.request, v)
+	s.cancel()
+
+	if !s.wroteHeader && !s.unidirectional && v != http.ErrAbortHandler {
+		s.wroteHeader = true
+		s.header = make(http.Header)
+
+		// Create the response SYN_REPLY.
+		synReply := new(frames.SYN_REPLY)
+		synReply.Flags = common.FLAG_FIN
+		synReply.StreamID = s.streamID
+		synReply.Header = make(http.Header)
+		synReply.Header.Set(":status", strconv.Itoa(http.StatusInternalServerError))
+		synReply.Header.Set(":version", "HTTP/1.1")
+
+		s.output <- synReply
+		s.record.WroteHeader(http.StatusInternalServerError)
+		s.record.Finish(common.StreamFinished, 0)
+		s.requestBody.Close()
+		s.state.CloseHere()
+		return
+	}
+
+	// Discard any unsent headers.
+	s.header = make(http.Header)
+
+	rst := new(frames.RST_STREAM)
+	rst.StreamID = s.streamID
+	rst.Status = common.RST_STREAM_INTERNAL_ERROR
+	s.conn.controlOutput <- rst
+	s.record.Finish(common.StreamReset, rst.Status)
+
+	s.Close()
+}
+
+// pushPreloads pushes the resources listed in the
+// response's Link headers with rel=preload, if
+// enabled. Each is served by the stream's handler,
+// as if it had been requested by the client.
+func (s *ResponseStream) pushPreloads() {
+	if !s.conn.config.PushPreloads || s.unidirectional || s.handler == nil {
+		return
+	}
+
+	for _, target := range common.PreloadLinks(s.header, s.request.URL) {
+		if !s.conn.preload(target) {
+			continue
+		}
+		request, err := common.PreloadRequest(s.request, target)
+		if err != nil {
+			s.conn.unpreload(target)
+			continue
+		}
+		push, err := s.conn.Push(target, s)
+		if err != nil {
+			debug.Printf("Failed to push %s: %v\n", target, err)
+			s.conn.unpreload(target)
+			continue
+		}
+
+		s.pushes.Add(1)
+		go s.servePush(s.handler, push, request.WithContext(push.Context()))
+	}
+}
+
+// servePush serves a preloaded resource on
+// the given push stream.
+func (s *ResponseStream) servePush(handler http.Handler, push common.PushStream, request *http.Request) {
+	defer s.pushes.Done()
+	defer func() {
+		if v := recover(); v != nil {
+			common.ReportHandlerPanic(push.StreamID(), request, v)
+			if !push.State().ClosedHere() {
+				s.conn._RST_STREAM(push.StreamID(), common.RST_STREAM_INTERNAL_ERROR)
+			}
+			push.Close()
+		}
+	}()
+
+	handler.ServeHTTP(push, request)
+	push.Finish()
+}
+
 func (s *ResponseStream) State() *common.StreamState {
 	return s.state
 }
@@ -375,5 +560,131 @@ func (s *ResponseStream) writeHeader() {
  ******************/
 
 func (s *ResponseStream) Priority() common.Priority {
+	s.Lock()
+	defer s.Unlock()
 	return s.priority
 }
+
+// SetPriority changes the priority at which the
+// stream's frames are sent, including any already
+// queued. SPDY/3 cannot signal the change, so it
+// affects only the frames sent by this endpoint.
+func (s *ResponseStream) SetPriority(priority common.Priority) error {
+	if !priority.Valid(3) {
+		return errors.New("Error: Invalid priority.")
+	}
+	s.Lock()
+	s.priority = priority
+	s.Unlock()
+	s.conn.setPriority(s.streamID, priority)
+	return nil
+}
+
+func (s *ResponseStream) accessRecord() *common.StreamRecorder {
+	return s.record
+}
+
+// requestBody is the Request's Body. As the
+// handler reads data, the transfer window is
+// regrown, so the client can only send as much
+// as the handler consumes.
+type requestBody struct {
+	*common.Pipe
+	stream *ResponseStream
+}
+
+func newRequestBody(stream *ResponseStream) *requestBody {
+	return &requestBody{common.NewPipeWithBudget(stream.conn.memory), stream}
+}
+
+func (r *requestBody) Read(b []byte) (int, error) {
+	n, err := r.Pipe.Read(b)
+	if n > 0 && r.stream.flow != nil {
+		r.stream.flow.Consume(n)
+	}
+	return n, err
+}
+
+// Close discards any buffered data, returning
+// its transfer window to the client.
+func (r *requestBody) Close() error {
+	n := r.Pipe.Discard()
+	if n > 0 && r.stream.flow != nil {
+		r.stream.flow.Consume(n)
+	}
+	return nil
+}
+
+/*******************
+ * StreamHijacker *
+ *******************/
+
+// HijackStream lets the handler take over the stream,
+// once the response headers have been sent. Reads
+// return data from the client as it arrives, and
+// writes are sent to the client as DATA frames.
+// Closing the returned stream half-closes the stream.
+//
+// Once the stream has been hijacked, the Request's Body
+// should not be used, and the stream is not closed when
+// the handler returns. The caller must close the returned
+// stream, which also ends the Request's context.
+func (s *ResponseStream) HijackStream() (io.ReadWriteCloser, error) {
+	if s.unidirectional {
+		return nil, errors.New("Error: Stream is unidirectional.")
+	}
+
+	if s.hijacked {
+		return nil, errors.New("Error: Stream already hijacked.")
+	}
+
+	// Send the response headers.
+	s.Flush()
+
+	if s.closed() || s.state.ClosedHere() {
+		return nil, errors.New("Error: Stream already closed.")
+	}
+
+	s.hijacked = true
+	return &hijackedStream{s}, nil
+}
+
+// hijackedStream is the io.ReadWriteCloser
+// returned by ResponseStream.HijackStream.
+type hijackedStream struct {
+	stream *ResponseStream
+}
+
+func (h *hijackedStream) Read(b []byte) (int, error) {
+	return h.stream.requestBody.Read(b)
+}
+
+func (h *hijackedStream) Write(b []byte) (int, error) {
+	return h.stream.Write(b)
+}
+
+// Close half-closes the stream, sending
+// an empty DATA frame with FIN set, and
+// ends the request's context. Data sent
+// by the client can still be read.
+func (h *hijackedStream) Close() error {
+	s := h.stream
+	if s.closed() || s.state.ClosedHere() {
+		return nil
+	}
+	defer s.cancel()
+
+	if err := s.flow.Drain(); err != nil {
+		log.Printf("Error: Stream %d has been closed with data still buffered.\n", s.streamID)
+	}
+
+	data := new(frames.DATA)
+	data.StreamID = s.streamID
+	data.Flags = common.FLAG_FIN
+	data.Data = []byte{}
+	s.output <- data
+
+	s.state.CloseHere()
+	s.record.Finish(common.StreamFinished, 0)
+	return nil
+}
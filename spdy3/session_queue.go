@@ -0,0 +1,243 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+// sessionQueue applies SPDY/3.1 session flow control
+// to outbound DATA frames. Frames which do not fit in
+// the session window are witheld in a queue for their
+// stream, so that one stream cannot hold up the others.
+//
+// As the window grows, it is shared between the streams
+// with witheld data in priority order, and round-robin
+// between streams of the same priority. Frames larger
+// than the available window are split.
+//
+// Witheld data is counted against the memory budget.
+type sessionQueue struct {
+	sync.Mutex
+	memory  *common.MemoryBudget             // accounts for witheld frames.
+	window  int64                            // session transfer window.
+	streams map[common.StreamID]*streamQueue // witheld frames for each stream.
+	ready   [8][]common.StreamID             // streams with witheld frames, by priority.
+}
+
+// streamQueue is the DATA witheld for one stream.
+type streamQueue struct {
+	priority common.Priority
+	frames   []*frames.DATA
+}
+
+func newSessionQueue(window int64, memory *common.MemoryBudget) *sessionQueue {
+	out := new(sessionQueue)
+	out.memory = memory
+	out.window = window
+	out.streams = make(map[common.StreamID]*streamQueue)
+	return out
+}
+
+// Send is called with each DATA frame to be sent,
+// along with its stream's priority. If the frame, or
+// part of it, can be sent now, that is returned and
+// any remainder is witheld. Otherwise, Send returns
+// nil.
+//
+// A stream's frames are always sent in order, so
+// a frame is witheld while its stream has others
+// waiting. Frames are also witheld while streams
+// of the same or higher priority are waiting, so
+// that they are not overtaken.
+func (q *sessionQueue) Send(frame *frames.DATA, priority common.Priority) *frames.DATA {
+	q.Lock()
+	defer q.Unlock()
+
+	if priority > 7 {
+		priority = 7
+	}
+
+	if queue, ok := q.streams[frame.StreamID]; ok {
+		queue.frames = append(queue.frames, frame)
+		q.memory.Acquire(len(frame.Data))
+		return nil
+	}
+
+	var out, rest *frames.DATA
+	if q.waiting(priority) {
+		rest = frame
+	} else {
+		out, rest = q.take(frame)
+	}
+	if rest != nil {
+		q.streams[frame.StreamID] = &streamQueue{priority: priority, frames: []*frames.DATA{rest}}
+		q.ready[priority] = append(q.ready[priority], frame.StreamID)
+		q.memory.Acquire(len(rest.Data))
+	}
+	return out
+}
+
+// waiting returns whether any streams of the
+// given priority or higher have witheld frames.
+func (q *sessionQueue) waiting(priority common.Priority) bool {
+	for p := common.Priority(0); p <= priority; p++ {
+		if len(q.ready[p]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the next witheld frame, or the part
+// of it that fits in the window, or nil if nothing
+// can be sent.
+func (q *sessionQueue) Next() *frames.DATA {
+	q.Lock()
+	defer q.Unlock()
+
+	for priority := range q.ready {
+		if len(q.ready[priority]) == 0 {
+			continue
+		}
+
+		// Take the next stream in turn.
+		sid := q.ready[priority][0]
+		queue := q.streams[sid]
+		out, rest := q.take(queue.frames[0])
+		if out == nil {
+			return nil
+		}
+		q.memory.Release(len(out.Data))
+
+		if rest != nil {
+			queue.frames[0] = rest
+		} else {
+			queue.frames[0] = nil
+			queue.frames = queue.frames[1:]
+		}
+
+		// Move the stream to the back of
+		// the queue, unless it is done.
+		q.ready[priority] = q.ready[priority][1:]
+		if len(queue.frames) > 0 {
+			q.ready[priority] = append(q.ready[priority], sid)
+		} else {
+			delete(q.streams, sid)
+		}
+
+		return out
+	}
+
+	return nil
+}
+
+// take divides the frame into the part which
+// fits in the window, which is charged to the
+// window, and the remainder. Either may be nil.
+func (q *sessionQueue) take(frame *frames.DATA) (out, rest *frames.DATA) {
+	size := int64(len(frame.Data))
+	if size <= q.window {
+		q.window -= size
+		return frame, nil
+	}
+	if q.window <= 0 {
+		return nil, frame
+	}
+
+	out = new(frames.DATA)
+	out.StreamID = frame.StreamID
+	out.Data = frame.Data[:q.window]
+
+	rest = new(frames.DATA)
+	rest.StreamID = frame.StreamID
+	rest.Flags = frame.Flags
+	rest.Data = frame.Data[q.window:]
+
+	q.window = 0
+	return out, rest
+}
+
+// Grow adds to the session window, as
+// given by a WINDOW_UPDATE.
+func (q *sessionQueue) Grow(delta uint32) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if int64(delta)+q.window > common.MAX_TRANSFER_WINDOW_SIZE {
+		return errors.New("Error: WINDOW_UPDATE delta window size overflows session window size.")
+	}
+	q.window += int64(delta)
+	return nil
+}
+
+// Discard drops any frames witheld for
+// the given stream, such as once it has
+// been reset.
+func (q *sessionQueue) Discard(streamID common.StreamID) {
+	q.Lock()
+	defer q.Unlock()
+
+	queue, ok := q.streams[streamID]
+	if !ok {
+		return
+	}
+	delete(q.streams, streamID)
+	for _, frame := range queue.frames {
+		q.memory.Release(len(frame.Data))
+	}
+
+	ready := q.ready[queue.priority]
+	for i, sid := range ready {
+		if sid == streamID {
+			q.ready[queue.priority] = append(ready[:i], ready[i+1:]...)
+			break
+		}
+	}
+}
+
+// SetPriority moves the given stream's
+// witheld frames to the given priority.
+func (q *sessionQueue) SetPriority(streamID common.StreamID, priority common.Priority) {
+	q.Lock()
+	defer q.Unlock()
+
+	if priority > 7 {
+		priority = 7
+	}
+	queue, ok := q.streams[streamID]
+	if !ok || queue.priority == priority {
+		return
+	}
+
+	ready := q.ready[queue.priority]
+	for i, sid := range ready {
+		if sid == streamID {
+			q.ready[queue.priority] = append(ready[:i], ready[i+1:]...)
+			break
+		}
+	}
+	queue.priority = priority
+	q.ready[priority] = append(q.ready[priority], streamID)
+}
+
+// Close drops all witheld frames, such
+// as once the connection has closed.
+func (q *sessionQueue) Close() {
+	q.Lock()
+	defer q.Unlock()
+
+	for _, queue := range q.streams {
+		for _, frame := range queue.frames {
+			q.memory.Release(len(frame.Data))
+		}
+	}
+	q.streams = make(map[common.StreamID]*streamQueue)
+	q.ready = [8][]common.StreamID{}
+}
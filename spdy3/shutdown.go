@@ -39,17 +39,9 @@ func (c *Conn) shutdown() {
 	c.goawayLock.Unlock()
 	if !sent && !isSending {
 		goaway := new(frames.GOAWAY)
-		if c.server != nil {
-			c.lastRequestStreamIDLock.Lock()
-			goaway.LastGoodStreamID = c.lastRequestStreamID
-			c.lastRequestStreamIDLock.Unlock()
-		} else {
-			c.lastPushStreamIDLock.Lock()
-			goaway.LastGoodStreamID = c.lastPushStreamID
-			c.lastPushStreamIDLock.Unlock()
-		}
+		goaway.LastGoodStreamID = c.lastGoodStreamID()
 		select {
-		case c.output[0] <- goaway:
+		case c.controlOutput <- goaway:
 			c.goawayLock.Lock()
 			c.goawaySent = true
 			c.goawayLock.Unlock()
@@ -81,6 +73,11 @@ func (c *Conn) shutdown() {
 		close(c.stop)
 	}
 
+	// Cancel any outstanding requests.
+	if c.cancelContext != nil {
+		c.cancelContext()
+	}
+
 	if c.conn != nil {
 		c.conn.Close()
 		c.conn = nil
@@ -93,15 +90,51 @@ func (c *Conn) shutdown() {
 	c.streams = nil
 	c.streamsLock.Unlock()
 
+	if c.session != nil {
+		c.session.Close()
+	}
+
+	// Drop any frames left queued.
+	c.schedulerLock.Lock()
+	for {
+		queued, ok := c.scheduler.Pop()
+		if !ok {
+			break
+		}
+		if data, ok := queued.Frame.(*frames.DATA); ok {
+			c.memory.Release(len(data.Data))
+		}
+	}
+	c.control = nil
+	c.schedulerLock.Unlock()
+
 	if c.compressor != nil {
 		c.compressor.Close()
 		c.compressor = nil
 	}
-	c.decompressor = nil
+	// The decompressor is left in place, as
+	// readFrames may still be decompressing a
+	// frame read before the connection closed.
+
+	if c.abuse != nil {
+		c.abuse.Close()
+	}
 
+	c.pushedResourcesLock.Lock()
 	c.pushedResources = nil
+	c.pushedResourcesLock.Unlock()
+
+	// Inform any outstanding PINGs that they failed.
+	c.pingsLock.Lock()
+	for pid, ping := range c.pings {
+		close(ping)
+		delete(c.pings, pid)
+		delete(c.pingTimes, pid)
+	}
+	c.pingsLock.Unlock()
 
-	for _, stream := range c.output {
+	outputs := append(c.output[:], c.controlOutput)
+	for _, stream := range outputs {
 		select {
 		case _, ok := <-stream:
 			if ok {
@@ -79,8 +79,16 @@ type Transport struct {
 	// PushReceiver is used to receive server pushes. If left nil,
 	// pushes will be refused. The provided Request will be that
 	// sent with the server push. See Receiver for more detail on
-	// its methods.
+	// its methods. Individual requests can be given their own push
+	// receivers with common.WithPushReceiver.
 	PushReceiver common.Receiver
+
+	// FlowControl, if non-nil, is called to produce the flow
+	// control mechanism for each new SPDY/3 connection, such
+	// as common.NewAutoFlowControl. Each connection must be
+	// given its own FlowControl. Individual requests can be
+	// given their own flow control with common.WithFlowControl.
+	FlowControl func() common.FlowControl
 }
 
 // NewTransport gives a simple initialised Transport.
@@ -93,6 +101,17 @@ func NewTransport(insecureSkipVerify bool) *Transport {
 	}
 }
 
+// setFlowControl applies the Transport's
+// FlowControl to a new connection.
+func (t *Transport) setFlowControl(conn common.Conn) {
+	if t.FlowControl == nil {
+		return
+	}
+	if controller, ok := conn.(SetFlowController); ok {
+		controller.SetFlowControl(t.FlowControl())
+	}
+}
+
 // dial makes the connection to an endpoint.
 func (t *Transport) dial(u *url.URL) (net.Conn, error) {
 
@@ -265,6 +284,7 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 				if err != nil {
 					return nil, err
 				}
+				t.setFlowControl(newConn)
 				go newConn.Run()
 				t.spdyConns[u.Host] = newConn
 				conn = newConn
@@ -274,6 +294,7 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 				if err != nil {
 					return nil, err
 				}
+				t.setFlowControl(newConn)
 				go newConn.Run()
 				t.spdyConns[u.Host] = newConn
 				conn = newConn
@@ -0,0 +1,167 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// DialTunnel is used to open a tunnel to addr, a host and
+// port, through a SPDY proxy server, using a CONNECT
+// request. The returned net.Conn sends and receives data
+// over the stream, and its CloseWrite method half-closes
+// the stream.
+//
+// If conn is not a SPDY client connection, DialTunnel will
+// return the ErrNotSPDY error.
+//
+// A simple example of tunnelling through a proxy is:
+//
+//      import (
+//              "crypto/tls"
+//              "github.com/SlyMarbo/spdy"
+//      )
+//
+//      func main() {
+//              conn, err := tls.Dial("tcp", "proxy.example.com:443", &tls.Config{
+//                      NextProtos: []string{"spdy/3.1"},
+//              })
+//              // ...
+//              client, err := spdy.NewClientConn(conn, nil, 3, 1)
+//              // ...
+//              go client.Run()
+//
+//              tunnel, err := spdy.DialTunnel(client, "example.com:22")
+//              // ...
+//      }
+func DialTunnel(conn common.Conn, addr string) (net.Conn, error) {
+	if tunneler, ok := conn.(Tunneler); !ok {
+		return nil, common.ErrNotSPDY
+	} else {
+		return tunneler.Connect(addr)
+	}
+}
+
+// DialTunnelContext is like DialTunnel, but gives up
+// waiting for the proxy's response once ctx is done.
+// Once the tunnel has been opened, ctx has no effect
+// on it.
+func DialTunnelContext(ctx context.Context, conn common.Conn, addr string) (net.Conn, error) {
+	if tunneler, ok := conn.(Tunneler); !ok {
+		return nil, common.ErrNotSPDY
+	} else {
+		return tunneler.ConnectContext(ctx, addr)
+	}
+}
+
+// ConnectProxy is an http.Handler which serves CONNECT
+// requests on SPDY streams, by dialing the requested host
+// and port, and relaying data between the stream and the
+// new connection. When either end finishes sending, the
+// other is half-closed.
+//
+// Other requests are passed to Handler, or given a 405
+// response if Handler is nil.
+//
+// By default, ConnectProxy is an open proxy: any client
+// can reach any address the server can, including hosts
+// on private networks and the server's own loopback
+// services. Servers reachable by untrusted clients should
+// set Allow, or a Dial function which enforces a policy.
+type ConnectProxy struct {
+	// Allow reports whether the request may open a
+	// tunnel to addr, a host and port. Requests which
+	// are not allowed are given a 403 response. If nil,
+	// all requests are allowed.
+	Allow func(r *http.Request, addr string) bool
+
+	// Dial is used to connect to the requested address.
+	// If nil, net.DialTimeout is used with a 30 second
+	// timeout.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// Handler serves requests other than CONNECT.
+	Handler http.Handler
+}
+
+func (p *ConnectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "CONNECT" {
+		if p.Handler != nil {
+			p.Handler.ServeHTTP(w, r)
+		} else {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if !UsingSPDY(w) {
+		http.Error(w, "CONNECT is only supported over SPDY.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if p.Allow != nil && !p.Allow(r, r.Host) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	dial := p.Dial
+	if dial == nil {
+		dial = func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, 30*time.Second)
+		}
+	}
+
+	remote, err := dial("tcp", r.Host)
+	if err != nil {
+		log.Printf("Error: Failed to connect to %s: %v\n", r.Host, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer remote.Close()
+
+	stream, err := Hijack(w)
+	if err != nil {
+		log.Printf("Error: Failed to hijack CONNECT stream: %v\n", err)
+		return
+	}
+
+	// Tear down the tunnel if the stream
+	// is reset or the connection closes.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			remote.Close()
+			stream.Close()
+		case <-done:
+		}
+	}()
+
+	// Client to remote.
+	sent := make(chan struct{})
+	go func() {
+		io.Copy(remote, stream)
+		if closer, ok := remote.(interface {
+			CloseWrite() error
+		}); ok {
+			closer.CloseWrite()
+		} else {
+			remote.Close()
+		}
+		close(sent)
+	}()
+
+	// Remote to client.
+	io.Copy(stream, remote)
+	stream.Close()
+	<-sent
+}
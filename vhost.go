@@ -0,0 +1,198 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// VirtualHosts is a Handler which serves several hosts from
+// a single server, each with its own certificate and Handler.
+// The certificate is chosen using the server name sent by
+// the client (SNI), and each request is dispatched to the
+// Handler for its host.
+//
+// A SPDY connection may be shared by several hosts, so each
+// stream's :host is checked against the certificate chosen
+// for its connection. Streams to hosts that the certificate
+// does not cover are refused with RST_STREAM, and HTTPS
+// requests to such hosts receive 421 Misdirected Request.
+// If the certificate cannot be found from the server's
+// TLSConfig, all streams on the connection are refused.
+//
+// Host names may begin with a wildcard label, as in
+// "*.example.com", which matches a single label. The zero
+// value of VirtualHosts serves no hosts.
+//
+// Example:
+//
+//      hosts := new(spdy.VirtualHosts)
+//      err := hosts.HandleFiles("example.com", "example.pem", "example.key", exampleHandler)
+//      if err != nil {
+//              // handle error.
+//      }
+//      err = hosts.HandleFiles("example.org", "org.pem", "org.key", orgHandler)
+//      if err != nil {
+//              // handle error.
+//      }
+//      log.Fatal(hosts.ListenAndServeTLS(":443"))
+type VirtualHosts struct {
+	lock  sync.RWMutex
+	hosts map[string]*virtualHost
+}
+
+var _ = common.HostRouter(&VirtualHosts{})
+
+type virtualHost struct {
+	cert    *tls.Certificate
+	handler http.Handler
+}
+
+// Handle registers the certificate and Handler for the
+// given host. The certificate must be valid for the host.
+// Handler is typically nil, in which case the
+// DefaultServeMux is used.
+func (v *VirtualHosts) Handle(host string, cert tls.Certificate, handler http.Handler) error {
+	name := normaliseHost(host)
+	if name == "" {
+		return fmt.Errorf("Error: Invalid host %q.", host)
+	}
+
+	if len(cert.Certificate) == 0 {
+		return errors.New("Error: No TLS certificate provided.")
+	}
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+	}
+	// A wildcard host needs a wildcard certificate.
+	if !common.CoversHost(cert.Leaf, strings.Replace(name, "*", "wildcard", 1)) {
+		return fmt.Errorf("Error: TLS certificate is not valid for host %q.", host)
+	}
+
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.hosts == nil {
+		v.hosts = make(map[string]*virtualHost)
+	}
+	if _, ok := v.hosts[name]; ok {
+		return fmt.Errorf("Error: Host %q is already handled.", host)
+	}
+	v.hosts[name] = &virtualHost{cert: &cert, handler: handler}
+	return nil
+}
+
+// HandleFiles is like Handle, but loads the certificate
+// and matching private key from the given files.
+func (v *VirtualHosts) HandleFiles(host, certFile, keyFile string, handler http.Handler) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return v.Handle(host, cert, handler)
+}
+
+// HostHandler returns the Handler for the given host,
+// which may include a port, or nil if the host is not
+// served.
+func (v *VirtualHosts) HostHandler(host string) http.Handler {
+	if vhost := v.lookup(host); vhost != nil {
+		return vhost.handler
+	}
+	return nil
+}
+
+// GetCertificate returns the certificate for the server
+// name requested by the client. It is used as the
+// GetCertificate function in the server's TLS config.
+func (v *VirtualHosts) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if vhost := v.lookup(hello.ServerName); vhost != nil {
+		return vhost.cert, nil
+	}
+	return nil, fmt.Errorf("Error: No TLS certificate for host %q.", hello.ServerName)
+}
+
+// ServeHTTP dispatches HTTPS and cleartext requests to the
+// Handler for their host. SPDY streams are dispatched
+// directly by the connection.
+func (v *VirtualHosts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vhost := v.lookup(r.Host)
+	if vhost != nil && r.TLS != nil {
+		// The host must be covered by the certificate
+		// chosen for the connection, not just its own.
+		sni := v.lookup(r.TLS.ServerName)
+		if sni == nil || !common.CoversHost(sni.cert.Leaf, r.Host) {
+			vhost = nil
+		}
+	}
+	if vhost == nil {
+		http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+		return
+	}
+	vhost.handler.ServeHTTP(w, r)
+}
+
+// ListenAndServeTLS listens on the TCP network address addr
+// and then calls ServeTLS to handle requests on incoming
+// connections.
+func (v *VirtualHosts) ListenAndServeTLS(addr string) error {
+	l, err := listen(addr)
+	if err != nil {
+		return err
+	}
+
+	return v.ServeTLS(l)
+}
+
+// ServeTLS accepts incoming connections on the Listener l,
+// serving both SPDY and HTTPS for each of the hosts.
+func (v *VirtualHosts) ServeTLS(l net.Listener) error {
+	config := &tls.Config{GetCertificate: v.GetCertificate}
+	return ServeTLS(l, config, v)
+}
+
+// lookup returns the virtual host serving
+// host, or nil if there is none.
+func (v *VirtualHosts) lookup(host string) *virtualHost {
+	name := normaliseHost(host)
+	if name == "" {
+		return nil
+	}
+
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	if vhost, ok := v.hosts[name]; ok {
+		return vhost
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		return v.hosts["*"+name[i:]]
+	}
+	return nil
+}
+
+// normaliseHost returns the lower-case
+// host name, without any port.
+func normaliseHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}